@@ -0,0 +1,87 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+)
+
+// registerBatch registers services, in one batch if the adapter supports
+// it, and returns the error of each of them. Without batch support they are
+// registered one after the other, the caller being already run in parallel
+// with the other containers.
+func (b *Bridge) registerBatch(parent context.Context, services []*Service) []error {
+	if batch, ok := b.registry.(BatchRegistryAdapter); ok {
+		return b.batch(parent, services, batch.RegisterBatch)
+	}
+	errs := make([]error, len(services))
+	for i, service := range services {
+		errs[i] = b.call(parent, func(ctx context.Context) error {
+			return b.registry.Register(ctx, service)
+		})
+	}
+	return errs
+}
+
+// deregisterBatch deregisters services, in one batch if the adapter
+// supports it, and returns the error of each of them. Without batch support
+// they are deregistered in parallel.
+func (b *Bridge) deregisterBatch(parent context.Context, services []*Service) []error {
+	if batch, ok := b.registry.(BatchRegistryAdapter); ok {
+		return b.batch(parent, services, batch.DeregisterBatch)
+	}
+	errs := make([]error, len(services))
+	parallel(b.concurrency(), len(services), func(i int) {
+		errs[i] = b.deregisterFrom(parent, services[i])
+	})
+	return errs
+}
+
+// batch runs op on services, retrying only the ones that failed with an
+// error that isn't permanent.
+func (b *Bridge) batch(parent context.Context, services []*Service, op func(ctx context.Context, services []*Service) []error) []error {
+	errs := make([]error, len(services))
+	if len(services) == 0 {
+		return errs
+	}
+	pending := make([]int, len(services)) // indexes of services left to retry
+	for i := range pending {
+		pending[i] = i
+	}
+	retry(parent, func() error {
+		if b.limiter != nil {
+			if err := b.limiter.Wait(parent); err != nil {
+				for _, i := range pending {
+					errs[i] = err
+				}
+				return err
+			}
+		}
+		batch := make([]*Service, len(pending))
+		for j, i := range pending {
+			batch[j] = services[i]
+		}
+		ctx, cancel := b.context(parent)
+		results := op(ctx, batch)
+		cancel()
+		if len(results) != len(batch) {
+			err := Permanent(fmt.Errorf("adapter returned %d results for %d services", len(results), len(batch)))
+			for _, i := range pending {
+				errs[i] = err
+			}
+			return err
+		}
+
+		var failed []int
+		var last error
+		for j, i := range pending {
+			errs[i] = results[j]
+			if results[j] != nil && !IsPermanent(results[j]) {
+				failed = append(failed, i)
+				last = results[j]
+			}
+		}
+		pending = failed
+		return last
+	})
+	return errs
+}
@@ -1,6 +1,7 @@
 package bridge
 
 import (
+	"context"
 	"errors"
 	"log"
 	"net"
@@ -11,19 +12,50 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	dockerapi "github.com/fsouza/go-dockerclient"
+	"golang.org/x/time/rate"
 )
 
 var serviceIDPattern = regexp.MustCompile(`^(.+?):([a-zA-Z0-9][a-zA-Z0-9_.-]+):[0-9]+(?::udp)?$`)
 
+// DefaultConcurrency is the number of containers synced or refreshed at
+// once when Config.Concurrency isn't set.
+const DefaultConcurrency = 8
+
 type Bridge struct {
+	registry RegistryAdapter
+	docker   *dockerapi.Client
+	config   Config
+
+	// mu guards containers only, and is never held while talking to Docker
+	// or the registry. Those calls happen under the lock of the container.
+	mu         sync.Mutex
+	containers map[string]*containerState
+
+	events    *serial
+	limiter   *rate.Limiter
+	refresher *scheduler
+
+	// running is held for reading by every public operation, so that
+	// Shutdown can wait for them to return.
+	running sync.RWMutex
+
+	// ctx is the parent of every registry operation, canceled by Shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// containerState holds the services registered for a container. Its lock
+// is held for the whole handling of an event or sync of the container.
+type containerState struct {
 	sync.Mutex
-	registry       RegistryAdapter
-	docker         *dockerapi.Client
-	services       map[string][]*Service
-	deadContainers map[string]*DeadContainer
-	config         Config
+	services []*Service
+	dead     *DeadContainer
+
+	// gone is set once the state was dropped from Bridge.containers.
+	gone bool
 }
 
 func New(docker *dockerapi.Client, adapterUri string, config Config) (*Bridge, error) {
@@ -36,60 +68,304 @@ func New(docker *dockerapi.Client, adapterUri string, config Config) (*Bridge, e
 		return nil, errors.New("unrecognized adapter: " + adapterUri)
 	}
 
-	log.Println("Using", uri.Scheme, "adapter:", uri)
-	return &Bridge{
-		docker:         docker,
-		config:         config,
-		registry:       factory.New(uri),
-		services:       make(map[string][]*Service),
-		deadContainers: make(map[string]*DeadContainer),
-	}, nil
+	log.Println("Using", uri.Scheme, "adapter:", redact(factory, uri))
+	registry, err := factory.New(uri)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := registry.(ListRegistryAdapter); config.Cleanup && !ok {
+		return nil, errors.New(uri.Scheme + " adapter can't list services, required by -cleanup")
+	}
+	if _, ok := registry.(TTLRegistryAdapter); config.RefreshTtl > 0 && !ok {
+		return nil, errors.New(uri.Scheme + " adapter doesn't support -ttl")
+	}
+	b := &Bridge{
+		docker:     docker,
+		config:     config,
+		registry:   registry,
+		containers: make(map[string]*containerState),
+		events:     newSerial(),
+	}
+	if config.RateLimit > 0 {
+		b.limiter = rate.NewLimiter(rate.Limit(config.RateLimit), 1)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.ctx, b.cancel = context.WithValue(ctx, lifetimeKey{}, ctx), cancel
+	b.refresher = newScheduler(b.concurrency(), b.refreshScheduled)
+	go b.refresher.run(b.ctx)
+	return b, nil
+}
+
+// redact returns uri as it may be logged, without the password of the user
+// info and the secret options of the adapter.
+func redact(factory AdapterFactory, uri *url.URL) string {
+	if secret, ok := factory.(SecretAdapterFactory); ok {
+		query := uri.Query()
+		for _, option := range secret.SecretOptions() {
+			query.Del(option)
+		}
+		redacted := *uri
+		redacted.RawQuery = query.Encode()
+		uri = &redacted
+	}
+	return uri.Redacted()
 }
 
 func (b *Bridge) Ping() error {
-	return b.registry.Ping()
+	ctx, cancel := b.context(b.ctx)
+	defer cancel()
+	return b.registry.Ping(ctx)
+}
+
+// Services lists the services known to the registry backend, or returns
+// ErrServicesUnsupported if the adapter can't.
+func (b *Bridge) Services() ([]*Service, error) {
+	lister, ok := b.registry.(ListRegistryAdapter)
+	if !ok {
+		return []*Service{}, ErrServicesUnsupported
+	}
+	ctx, cancel := b.context(b.ctx)
+	defer cancel()
+	return lister.Services(ctx)
+}
+
+// Health reports whether the registry backend is healthy. Adapters that
+// can't tell more are healthy as long as they answer Ping.
+func (b *Bridge) Health() error {
+	health, ok := b.registry.(HealthRegistryAdapter)
+	if !ok {
+		return b.Ping()
+	}
+	ctx, cancel := b.context(b.ctx)
+	defer cancel()
+	return health.Health(ctx)
+}
+
+// Shutdown cancels the registry operations in progress and makes any later
+// one fail right away. It returns once the bridge is no longer busy, after
+// deregistering all services if Config.DeregisterOnShutdown is set.
+func (b *Bridge) Shutdown() {
+	b.cancel()
+	b.running.Lock()
+	defer b.running.Unlock()
+	if !b.config.DeregisterOnShutdown {
+		return
+	}
+
+	var services []*Service
+	_, states := b.snapshot()
+	for _, state := range states {
+		services = append(services, state.services...)
+	}
+	log.Printf("Deregistering %d services", len(services))
+	for i, err := range b.deregisterBatch(context.Background(), services) {
+		if err != nil {
+			log.Println("deregister failed:", services[i].ID, err)
+			continue
+		}
+		log.Println("removed:", services[i].ID)
+	}
+}
+
+type lifetimeKey struct{}
+
+// Lifetime returns the context of the bridge that ctx, as passed to an
+// adapter, derives from. Unlike ctx it isn't bounded by the operation, only
+// canceled by Shutdown, so adapters use it for work outliving the call,
+// e.g. a watch started by Ping. For any other context it returns ctx.
+func Lifetime(ctx context.Context) context.Context {
+	if lifetime, ok := ctx.Value(lifetimeKey{}).(context.Context); ok {
+		return lifetime
+	}
+	return ctx
+}
+
+// context returns the context of a single registry operation, bounded by
+// the configured backend timeout.
+func (b *Bridge) context(parent context.Context) (context.Context, context.CancelFunc) {
+	if b.config.BackendTimeout > 0 {
+		return context.WithTimeout(parent, time.Duration(b.config.BackendTimeout)*time.Second)
+	}
+	return context.WithCancel(parent)
+}
+
+// call runs op against the registry, giving each attempt its own deadline
+// derived from parent. Failures that aren't permanent are retried a few
+// times with backoff. Attempts wait for the rate limiter, if any.
+func (b *Bridge) call(parent context.Context, op func(ctx context.Context) error) error {
+	return retry(parent, func() error {
+		if b.limiter != nil {
+			if err := b.limiter.Wait(parent); err != nil {
+				return err
+			}
+		}
+		ctx, cancel := b.context(parent)
+		defer cancel()
+		return op(ctx)
+	})
+}
+
+func (b *Bridge) register(service *Service) error {
+	return b.call(b.ctx, func(ctx context.Context) error {
+		return b.registry.Register(ctx, service)
+	})
+}
+
+func (b *Bridge) deregister(service *Service) error {
+	return b.deregisterFrom(b.ctx, service)
+}
+
+func (b *Bridge) deregisterFrom(parent context.Context, service *Service) error {
+	return b.call(parent, func(ctx context.Context) error {
+		return b.registry.Deregister(ctx, service)
+	})
+}
+
+func (b *Bridge) refresh(service *Service) error {
+	ttl, ok := b.registry.(TTLRegistryAdapter)
+	if !ok {
+		return nil
+	}
+	return b.call(b.ctx, func(ctx context.Context) error {
+		return ttl.Refresh(ctx, service)
+	})
+}
+
+func (b *Bridge) update(service *Service) error {
+	return b.call(b.ctx, func(ctx context.Context) error {
+		return b.registry.(UpdateRegistryAdapter).Update(ctx, service)
+	})
+}
+
+// concurrency returns how many containers are synced or refreshed at once.
+func (b *Bridge) concurrency() int {
+	if b.config.Concurrency > 0 {
+		return b.config.Concurrency
+	}
+	return DefaultConcurrency
+}
+
+// lockContainer returns the locked state of a container, creating it if
+// needed.
+func (b *Bridge) lockContainer(containerId string) *containerState {
+	for {
+		b.mu.Lock()
+		state := b.containers[containerId]
+		if state == nil {
+			state = new(containerState)
+			b.containers[containerId] = state
+		}
+		b.mu.Unlock()
+
+		state.Lock()
+		if !state.gone {
+			return state
+		}
+		// dropped while we were waiting for it, start over
+		state.Unlock()
+	}
+}
+
+// unlockContainer unlocks the state of a container, dropping it if nothing
+// is left to track.
+func (b *Bridge) unlockContainer(containerId string, state *containerState) {
+	if state.services == nil && state.dead == nil && !state.gone {
+		b.mu.Lock()
+		delete(b.containers, containerId)
+		b.mu.Unlock()
+		state.gone = true
+	}
+	state.Unlock()
+}
+
+// snapshot returns the containers currently tracked, without locking them.
+func (b *Bridge) snapshot() ([]string, []*containerState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := make([]string, 0, len(b.containers))
+	states := make([]*containerState, 0, len(b.containers))
+	for id, state := range b.containers {
+		ids = append(ids, id)
+		states = append(states, state)
+	}
+	return ids, states
+}
+
+// Dispatch runs handler for a container in the background, once the
+// handlers dispatched earlier for the same container have returned.
+// Handlers of different containers run concurrently.
+func (b *Bridge) Dispatch(containerId string, handler func(containerId string)) {
+	b.events.do(containerId, func() { handler(containerId) })
 }
 
 func (b *Bridge) Add(containerId string) {
-	b.Lock()
-	defer b.Unlock()
-	b.add(containerId, false)
+	b.running.RLock()
+	defer b.running.RUnlock()
+	state := b.lockContainer(containerId)
+	defer b.unlockContainer(containerId, state)
+	b.add(containerId, state, false)
 }
 
 func (b *Bridge) Remove(containerId string) {
+	b.running.RLock()
+	defer b.running.RUnlock()
 	b.remove(containerId, true)
 }
 
 func (b *Bridge) RemoveOnExit(containerId string) {
+	b.running.RLock()
+	defer b.running.RUnlock()
 	b.remove(containerId, b.config.DeregisterCheck == "always" || b.didExitCleanly(containerId))
 }
 
-func (b *Bridge) Refresh() {
-	b.Lock()
-	defer b.Unlock()
-
-	for containerId, deadContainer := range b.deadContainers {
-		deadContainer.TTL -= b.config.RefreshInterval
-		if deadContainer.TTL <= 0 {
-			delete(b.deadContainers, containerId)
-		}
+// UpdateHealth registers the services of a container again once the status
+// of its Docker health check changed, so that the backend gets the new one.
+func (b *Bridge) UpdateHealth(containerId string) {
+	b.running.RLock()
+	defer b.running.RUnlock()
+	state := b.lockContainer(containerId)
+	defer b.unlockContainer(containerId, state)
+	if state.services == nil {
+		return
 	}
+	container, err := b.docker.InspectContainer(containerId)
+	if err != nil {
+		log.Println("unable to inspect container:", containerId[:12], err)
+		return
+	}
+	b.updateHealth(containerId, state, container.State.Health.Status)
+}
 
-	for containerId, services := range b.services {
-		for _, service := range services {
-			err := b.registry.Refresh(service)
-			if err != nil {
-				log.Println("refresh failed:", service.ID, err)
-				continue
-			}
-			log.Println("refreshed:", containerId[:12], service.ID)
+// updateHealth replaces the services of a container whose health status
+// differs with copies carrying the new one, and registers them, in place if
+// the adapter can. Must be called with the lock of the container held.
+func (b *Bridge) updateHealth(containerId string, state *containerState, status string) {
+	_, updating := b.registry.(UpdateRegistryAdapter)
+	for i, service := range state.services {
+		if service.Origin.Health == status {
+			continue
+		}
+		updated := *service
+		updated.Origin.Health = status
+		var err error
+		if updating {
+			err = b.update(&updated)
+		} else {
+			err = b.register(&updated)
+		}
+		if err != nil {
+			log.Println("health update failed:", service.ID, err)
+			continue
 		}
+		state.services[i] = &updated
+		b.schedule(containerId, &updated)
+		log.Println("health:", containerId[:12], service.ID, status)
 	}
 }
 
 func (b *Bridge) Sync(quiet bool) {
-	b.Lock()
-	defer b.Unlock()
+	b.running.RLock()
+	defer b.running.RUnlock()
 
 	containers, err := b.docker.ListContainers(dockerapi.ListContainersOptions{})
 	if err != nil && quiet {
@@ -101,17 +377,45 @@ func (b *Bridge) Sync(quiet bool) {
 
 	log.Printf("Syncing services on %d containers", len(containers))
 
-	// NOTE: This assumes reregistering will do the right thing, i.e. nothing..
-	for _, listing := range containers {
-		services := b.services[listing.ID]
-		if services == nil {
-			b.add(listing.ID, quiet)
-		} else {
-			for _, service := range services {
-				err := b.registry.Register(service)
-				if err != nil {
-					log.Println("sync register failed:", service, err)
-				}
+	// Compare with what the backend holds when it can tell, and only
+	// register the services that are missing or were modified. Otherwise
+	// register everything again and rely on that doing nothing.
+	extServices, err := b.Services()
+	diff := err == nil
+	if err != nil && err != ErrServicesUnsupported {
+		log.Println("unable to list services, registering all of them:", err)
+	}
+	backend := make(map[string]*Service, len(extServices))
+	for _, extService := range extServices {
+		backend[extService.ID] = extService
+	}
+
+	// With a batch adapter, the services of all containers are registered
+	// at once, and the containers stay locked until then.
+	_, batching := b.registry.(BatchRegistryAdapter)
+	var stats syncStats
+	var mu sync.Mutex
+	var items []syncItem
+	locked := make([]*containerState, len(containers))
+	parallel(b.concurrency(), len(containers), func(i int) {
+		containerId := containers[i].ID
+		state := b.lockContainer(containerId)
+		pending := b.syncItems(containerId, state, backend, diff, quiet, &stats)
+		if !batching {
+			b.registerItems(pending, diff, &stats)
+			b.unlockContainer(containerId, state)
+			return
+		}
+		locked[i] = state
+		mu.Lock()
+		items = append(items, pending...)
+		mu.Unlock()
+	})
+	if batching {
+		b.registerItems(items, diff, &stats)
+		for i, state := range locked {
+			if state != nil {
+				b.unlockContainer(containers[i].ID, state)
 			}
 		}
 	}
@@ -119,61 +423,262 @@ func (b *Bridge) Sync(quiet bool) {
 	// Clean up services that were registered previously, but aren't
 	// acknowledged within registrator
 	if b.config.Cleanup {
-		log.Println("Cleaning up dangling services")
-
-		extServices, err := b.registry.Services()
-		if err != nil {
+		if diff {
+			b.cleanup(extServices, &stats)
+		} else {
 			log.Println("cleanup failed:", err)
-			return
 		}
+	}
 
-	Outer:
-		for _, extService := range extServices {
-			matches := serviceIDPattern.FindStringSubmatch(extService.ID)
-			if len(matches) != 3 {
-				// There's no way this was registered by us, so leave it
-				continue
-			}
-			serviceHostname := matches[1]
-			if serviceHostname != Hostname {
-				// ignore because registered on a different host
-				continue
-			}
-			serviceContainerName := matches[2]
-			for _, listing := range b.services {
-				for _, service := range listing {
-					if service.Name == extService.Name && serviceContainerName == service.Origin.container.Name[1:] {
-						continue Outer
-					}
-				}
-			}
-			log.Println("dangling:", extService.ID)
-			err := b.registry.Deregister(extService)
-			if err != nil {
-				log.Println("deregister failed:", extService.ID, err)
-				continue
+	if diff {
+		log.Printf("Sync corrected %d missing, %d modified and %d dangling services, %d unchanged",
+			stats.missing, stats.modified, stats.dangling, stats.unchanged)
+	}
+}
+
+// syncStats counts the drift between registrator and the backend corrected
+// by a sync.
+type syncStats struct {
+	sync.Mutex
+	missing, modified, dangling, unchanged int
+}
+
+func (s *syncStats) add(counter *int) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	*counter++
+	s.Unlock()
+}
+
+// syncItem is a service to register, along with the container it belongs
+// to. Services of containers seen for the first time are added to them once
+// registered.
+type syncItem struct {
+	containerId string
+	state       *containerState
+	service     *Service
+	added       bool
+	extService  *Service // the backend's copy, if any
+}
+
+// syncItems returns the services of a container to register on sync,
+// leaving out those the backend holds unmodified. Must be called with the
+// lock of the container held.
+func (b *Bridge) syncItems(containerId string, state *containerState, backend map[string]*Service, diff, quiet bool, stats *syncStats) []syncItem {
+	if state.services == nil {
+		return b.addItems(containerId, state, quiet)
+	}
+	var items []syncItem
+	for _, service := range state.services {
+		extService := backend[service.ID]
+		if diff && extService != nil && !serviceModified(service, extService) {
+			stats.add(&stats.unchanged)
+			continue
+		}
+		items = append(items, syncItem{containerId: containerId, state: state, service: service, extService: extService})
+	}
+	return items
+}
+
+// registerItems registers services, in one batch if the adapter supports
+// it. Services modified in the backend are updated in place instead if the
+// adapter can. The locks of their containers must be held.
+func (b *Bridge) registerItems(items []syncItem, diff bool, stats *syncStats) {
+	_, updating := b.registry.(UpdateRegistryAdapter)
+	errs := make([]error, len(items))
+	var batch []*Service
+	var batched []int
+	for i, item := range items {
+		if updating && item.extService != nil {
+			errs[i] = b.update(item.service)
+			continue
+		}
+		batch = append(batch, item.service)
+		batched = append(batched, i)
+	}
+	for j, err := range b.registerBatch(b.ctx, batch) {
+		errs[batched[j]] = err
+	}
+
+	for i, err := range errs {
+		item := items[i]
+		if err != nil {
+			if item.added {
+				log.Println("register failed:", item.service, err)
+			} else {
+				log.Println("sync register failed:", item.service, err)
 			}
-			log.Println(extService.ID, "removed")
+			continue
+		}
+		if item.added {
+			item.state.services = append(item.state.services, item.service)
+			b.schedule(item.containerId, item.service)
+			log.Println("added:", item.containerId[:12], item.service.ID)
+			continue
+		}
+		if !diff {
+			continue
+		}
+		if item.extService == nil {
+			log.Println("sync registered missing:", item.service.ID)
+			stats.add(&stats.missing)
+		} else {
+			log.Println("sync updated modified:", item.service.ID)
+			stats.add(&stats.modified)
 		}
 	}
 }
 
-func (b *Bridge) add(containerId string, quiet bool) {
-	if d := b.deadContainers[containerId]; d != nil {
-		b.services[containerId] = d.Services
-		delete(b.deadContainers, containerId)
+// serviceModified reports whether the backend's copy of a service differs
+// from the service registered. Tags are only compared if the backend
+// returned any, since not every backend stores them.
+func serviceModified(service, extService *Service) bool {
+	if service.Name != extService.Name || service.IP != extService.IP || service.Port != extService.Port {
+		return true
+	}
+	if len(extService.Tags) == 0 {
+		return false
+	}
+	if len(service.Tags) != len(extService.Tags) {
+		return true
+	}
+	tags := make(map[string]int)
+	for _, tag := range service.Tags {
+		tags[tag]++
 	}
+	for _, tag := range extService.Tags {
+		tags[tag]--
+	}
+	for _, count := range tags {
+		if count != 0 {
+			return true
+		}
+	}
+	return false
+}
 
-	if b.services[containerId] != nil {
+// cleanup deregisters the services of this host the backend knows about
+// but registrator doesn't.
+func (b *Bridge) cleanup(extServices []*Service, stats *syncStats) {
+	log.Println("Cleaning up dangling services")
+
+	// collect the services registrator knows about now, so that the ones
+	// added while the backend was listed are kept
+	known := make(map[string]bool)
+	_, states := b.snapshot()
+	for _, state := range states {
+		state.Lock()
+		for _, service := range state.services {
+			known[service.ID] = true
+		}
+		state.Unlock()
+	}
+
+	dangling := danglingServices(extServices, known)
+	for _, extService := range dangling {
+		log.Println("dangling:", extService.ID)
+	}
+	for i, err := range b.deregisterBatch(b.ctx, dangling) {
+		if err != nil {
+			log.Println("deregister failed:", dangling[i].ID, err)
+			continue
+		}
+		stats.add(&stats.dangling)
+		log.Println(dangling[i].ID, "removed")
+	}
+}
+
+// danglingServices returns the services registered for containers of this
+// host that aren't known.
+func danglingServices(extServices []*Service, known map[string]bool) []*Service {
+	dangling := make([]*Service, 0)
+	for _, extService := range extServices {
+		matches := serviceIDPattern.FindStringSubmatch(extService.ID)
+		if len(matches) != 3 {
+			// There's no way this was registered by us, so leave it
+			continue
+		}
+		serviceHostname := matches[1]
+		if serviceHostname != Hostname {
+			// ignore because registered on a different host
+			continue
+		}
+		if known[extService.ID] {
+			continue
+		}
+		dangling = append(dangling, extService)
+	}
+	return dangling
+}
+
+// refreshScheduled refreshes the TTL of a service for the scheduler. It
+// reports false if the container no longer has the service registered.
+func (b *Bridge) refreshScheduled(entry *refreshEntry) (bool, error) {
+	b.running.RLock()
+	defer b.running.RUnlock()
+
+	b.mu.Lock()
+	state := b.containers[entry.containerId]
+	b.mu.Unlock()
+	if state == nil {
+		return false, nil
+	}
+	state.Lock()
+	defer state.Unlock()
+	if state.gone || !hasService(state.services, entry.service) {
+		return false, nil
+	}
+
+	err := b.refresh(entry.service)
+	if err != nil {
+		log.Println("refresh failed:", entry.service.ID, err)
+		return true, err
+	}
+	log.Println("refreshed:", entry.containerId[:12], entry.service.ID)
+	return true, nil
+}
+
+// schedule starts refreshing the TTL of a service, if it has one.
+func (b *Bridge) schedule(containerId string, service *Service) {
+	if _, ok := b.registry.(TTLRegistryAdapter); !ok {
+		return
+	}
+	if b.refresher != nil && service.TTL > 0 {
+		b.refresher.add(containerId, service, service.refreshInterval)
+	}
+}
+
+// add registers the services of a container. Must be called with the lock
+// of the container held.
+func (b *Bridge) add(containerId string, state *containerState, quiet bool) {
+	b.registerItems(b.addItems(containerId, state, quiet), false, nil)
+}
+
+// addItems returns the services of a container to register, after
+// inspecting it. Must be called with the lock of the container held.
+func (b *Bridge) addItems(containerId string, state *containerState, quiet bool) []syncItem {
+	if d := state.dead; d != nil {
+		state.dead = nil
+		if time.Now().Before(d.Expires) {
+			state.services = d.Services
+			for _, service := range state.services {
+				b.schedule(containerId, service)
+			}
+		}
+	}
+
+	if state.services != nil {
 		log.Println("container, ", containerId[:12], ", already exists, ignoring")
 		// Alternatively, remove and readd or resubmit.
-		return
+		return nil
 	}
 
 	container, err := b.docker.InspectContainer(containerId)
 	if err != nil {
 		log.Println("unable to inspect container:", containerId[:12], err)
-		return
+		return nil
 	}
 
 	ports := make(map[string]ServicePort)
@@ -200,15 +705,18 @@ func (b *Bridge) add(containerId string, quiet bool) {
 				PortType:          porttype,
 				ContainerID:       container.ID,
 				ContainerHostname: container.Config.Hostname,
+				ContainerName:     strings.TrimPrefix(container.Name, "/"),
+				Health:            container.State.Health.Status,
 				container:         container}
 		}
 	}
 
 	if len(ports) == 0 && !quiet {
 		log.Println("ignored:", container.ID[:12], "no published ports")
-		return
+		return nil
 	}
 
+	var items []syncItem
 	for _, port := range ports {
 		if b.config.Internal != true && port.HostPort == "" {
 			if !quiet {
@@ -223,14 +731,9 @@ func (b *Bridge) add(containerId string, quiet bool) {
 			}
 			continue
 		}
-		err := b.registry.Register(service)
-		if err != nil {
-			log.Println("register failed:", service, err)
-			continue
-		}
-		b.services[container.ID] = append(b.services[container.ID], service)
-		log.Println("added:", container.ID[:12], service.ID)
+		items = append(items, syncItem{containerId: container.ID, state: state, service: service, added: true})
 	}
+	return items
 }
 
 func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
@@ -322,37 +825,90 @@ func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
 	delete(metadata, "name")
 	delete(metadata, "name_ipv6")
 	delete(metadata, "name_ipv4")
+	service.TTL, service.refreshInterval = b.serviceTTL(service.ID, metadata)
+	delete(metadata, "ttl")
+	delete(metadata, "ttl_refresh")
 	service.Attrs = metadata
-	service.TTL = b.config.RefreshTtl
 
 	return service
 }
 
 func (b *Bridge) remove(containerId string, deregister bool) {
-	b.Lock()
-	defer b.Unlock()
+	state := b.lockContainer(containerId)
+	defer b.unlockContainer(containerId, state)
 
 	if deregister {
-		deregisterAll := func(services []*Service) {
-			for _, service := range services {
-				err := b.registry.Deregister(service)
-				if err != nil {
-					log.Println("deregister failed:", service.ID, err)
-					continue
-				}
-				log.Println("removed:", containerId[:12], service.ID)
-			}
+		services := state.services
+		if d := state.dead; d != nil {
+			services = append(services[:len(services):len(services)], d.Services...)
+			state.dead = nil
 		}
-		deregisterAll(b.services[containerId])
-		if d := b.deadContainers[containerId]; d != nil {
-			deregisterAll(d.Services)
-			delete(b.deadContainers, containerId)
+		for i, err := range b.deregisterBatch(b.ctx, services) {
+			if err != nil {
+				log.Println("deregister failed:", services[i].ID, err)
+				continue
+			}
+			log.Println("removed:", containerId[:12], services[i].ID)
 		}
-	} else if b.config.RefreshTtl != 0 && b.services[containerId] != nil {
+	} else if ttl := maxTTL(state.services); ttl > 0 {
 		// need to stop the refreshing, but can't delete it yet
-		b.deadContainers[containerId] = &DeadContainer{b.config.RefreshTtl, b.services[containerId]}
+		dead := &DeadContainer{time.Now().Add(ttl), state.services}
+		state.dead = dead
+		time.AfterFunc(ttl, func() { b.expire(containerId, dead) })
+	}
+	state.services = nil
+}
+
+// expire forgets the services of a dead container once their TTL ran out,
+// unless the container was started or removed in the meantime.
+func (b *Bridge) expire(containerId string, dead *DeadContainer) {
+	b.mu.Lock()
+	state := b.containers[containerId]
+	b.mu.Unlock()
+	if state == nil {
+		return
+	}
+	state.Lock()
+	defer b.unlockContainer(containerId, state)
+	if state.dead == dead {
+		state.dead = nil
+	}
+}
+
+// serviceTTL returns the TTL of a service and how often to refresh it,
+// from the SERVICE_TTL and SERVICE_TTL_REFRESH attributes or the defaults.
+func (b *Bridge) serviceTTL(id string, metadata map[string]string) (int, time.Duration) {
+	ttl := b.config.RefreshTtl
+	if value := metadata["ttl"]; value != "" {
+		t, err := strconv.Atoi(value)
+		if err != nil || t < 0 {
+			log.Println("ignoring invalid ttl:", id, value)
+		} else {
+			ttl = t
+		}
+	}
+	if ttl == 0 {
+		return 0, 0
+	}
+
+	refresh := b.config.RefreshInterval
+	if value := metadata["ttl_refresh"]; value != "" {
+		r, err := strconv.Atoi(value)
+		if err != nil || r <= 0 {
+			log.Println("ignoring invalid ttl_refresh:", id, value)
+		} else {
+			refresh = r
+		}
+	}
+	if refresh <= 0 || refresh >= ttl {
+		// refresh well before the TTL runs out
+		refresh = ttl / 2
+	}
+	interval := time.Duration(refresh) * time.Second
+	if refresh == 0 {
+		interval = time.Duration(ttl) * time.Second / 2
 	}
-	delete(b.services, containerId)
+	return ttl, interval
 }
 
 func (b *Bridge) didExitCleanly(containerId string) bool {
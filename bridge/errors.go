@@ -0,0 +1,43 @@
+package bridge
+
+import "errors"
+
+// PermanentError wraps an adapter error that retrying the operation won't
+// fix, such as a service the backend rejects as invalid. Any other error
+// is assumed to be a transient, e.g. network, failure.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent marks err as permanent. It returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	if IsPermanent(err) {
+		return err
+	}
+	return &PermanentError{err}
+}
+
+// IsPermanent reports whether err, or an error it wraps, was marked as
+// permanent.
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// PermanentStatus reports whether an HTTP status code returned by a backend
+// means the request itself is at fault: any 4xx except timeouts and rate
+// limiting.
+func PermanentStatus(code int) bool {
+	return code >= 400 && code < 500 && code != 408 && code != 429
+}
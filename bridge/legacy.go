@@ -0,0 +1,115 @@
+package bridge
+
+import "context"
+
+// LegacyRegistryAdapter is the adapter interface from before operations
+// took a context. Third-party adapters still implementing it can be
+// returned from a factory wrapped with Legacy.
+type LegacyRegistryAdapter interface {
+	Ping() error
+	Register(service *Service) error
+	Deregister(service *Service) error
+}
+
+// LegacyListRegistryAdapter is implemented by legacy adapters that can list
+// the services registered in them.
+type LegacyListRegistryAdapter interface {
+	LegacyRegistryAdapter
+	Services() ([]*Service, error)
+}
+
+// LegacyTTLRegistryAdapter is implemented by legacy adapters that can
+// refresh the TTL of services.
+type LegacyTTLRegistryAdapter interface {
+	LegacyRegistryAdapter
+	Refresh(service *Service) error
+}
+
+// Legacy turns a LegacyRegistryAdapter into a RegistryAdapter, which is a
+// ListRegistryAdapter or TTLRegistryAdapter only if the legacy adapter has
+// Services or Refresh. The calls can't be interrupted, but the bridge stops
+// waiting for them once their context is done.
+func Legacy(adapter LegacyRegistryAdapter) RegistryAdapter {
+	core := &legacyAdapter{adapter}
+	lister, list := adapter.(LegacyListRegistryAdapter)
+	refresher, ttl := adapter.(LegacyTTLRegistryAdapter)
+	switch {
+	case list && ttl:
+		return &struct {
+			*legacyAdapter
+			legacyLister
+			legacyRefresher
+		}{core, legacyLister{lister}, legacyRefresher{refresher}}
+	case list:
+		return &struct {
+			*legacyAdapter
+			legacyLister
+		}{core, legacyLister{lister}}
+	case ttl:
+		return &struct {
+			*legacyAdapter
+			legacyRefresher
+		}{core, legacyRefresher{refresher}}
+	}
+	return core
+}
+
+type legacyAdapter struct {
+	adapter LegacyRegistryAdapter
+}
+
+func (l *legacyAdapter) Ping(ctx context.Context) error {
+	return Await(ctx, l.adapter.Ping)
+}
+
+func (l *legacyAdapter) Register(ctx context.Context, service *Service) error {
+	return Await(ctx, func() error { return l.adapter.Register(service) })
+}
+
+func (l *legacyAdapter) Deregister(ctx context.Context, service *Service) error {
+	return Await(ctx, func() error { return l.adapter.Deregister(service) })
+}
+
+type legacyRefresher struct {
+	adapter LegacyTTLRegistryAdapter
+}
+
+func (l legacyRefresher) Refresh(ctx context.Context, service *Service) error {
+	return Await(ctx, func() error { return l.adapter.Refresh(service) })
+}
+
+type legacyLister struct {
+	adapter LegacyListRegistryAdapter
+}
+
+func (l legacyLister) Services(ctx context.Context) ([]*Service, error) {
+	var services []*Service
+	err := Await(ctx, func() error {
+		var err error
+		services, err = l.adapter.Services()
+		return err
+	})
+	if err != nil {
+		return []*Service{}, err
+	}
+	return services, nil
+}
+
+// Await runs fn in its own goroutine and waits until it returns or ctx is
+// done, whichever comes first. It is meant for client libraries without
+// context support: fn keeps running in the background after a timeout.
+func Await(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
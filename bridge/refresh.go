@@ -0,0 +1,177 @@
+package bridge
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// scheduler refreshes every service on its own interval. New services are
+// spread over their interval, and each refresh comes a little early rather
+// than late, so that services registered together don't stay in lockstep.
+// A failed refresh is retried after a quarter of the interval.
+type scheduler struct {
+	sync.Mutex
+	queue   refreshQueue
+	entries map[*Service]*refreshEntry
+	wake    chan struct{}
+	rand    *rand.Rand
+
+	// refresh refreshes a service, reporting false if it is no longer
+	// registered so it must be dropped.
+	refresh func(entry *refreshEntry) (bool, error)
+	slots   chan struct{}
+}
+
+type refreshEntry struct {
+	containerId string
+	service     *Service
+	interval    time.Duration
+	due         time.Time
+	index       int
+}
+
+func newScheduler(concurrency int, refresh func(entry *refreshEntry) (bool, error)) *scheduler {
+	return &scheduler{
+		entries: make(map[*Service]*refreshEntry),
+		wake:    make(chan struct{}, 1),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		refresh: refresh,
+		slots:   make(chan struct{}, concurrency),
+	}
+}
+
+// add schedules the refreshes of service, unless they already are.
+func (s *scheduler) add(containerId string, service *Service, interval time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.entries[service]; ok {
+		return
+	}
+	entry := &refreshEntry{
+		containerId: containerId,
+		service:     service,
+		interval:    interval,
+		due:         time.Now().Add(time.Duration(s.rand.Int63n(int64(interval))) + 1),
+	}
+	s.entries[service] = entry
+	heap.Push(&s.queue, entry)
+	if entry.index == 0 {
+		s.notify()
+	}
+}
+
+// next puts entry back in the queue after a refresh.
+func (s *scheduler) next(entry *refreshEntry, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	if ok {
+		jitter := time.Duration(s.rand.Int63n(int64(entry.interval)/10 + 1))
+		entry.due = time.Now().Add(entry.interval - jitter)
+	} else {
+		retry := entry.interval / 4
+		if retry < time.Second {
+			retry = time.Second
+		}
+		entry.due = time.Now().Add(retry)
+	}
+	heap.Push(&s.queue, entry)
+	if entry.index == 0 {
+		s.notify()
+	}
+}
+
+// drop stops refreshing entry.
+func (s *scheduler) drop(entry *refreshEntry) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.entries, entry.service)
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due pops the entries due by now, and returns how long to wait for the
+// next one.
+func (s *scheduler) due(now time.Time) ([]*refreshEntry, time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	var due []*refreshEntry
+	for len(s.queue) > 0 && !s.queue[0].due.After(now) {
+		due = append(due, heap.Pop(&s.queue).(*refreshEntry))
+	}
+	if len(s.queue) == 0 {
+		return due, time.Hour
+	}
+	return due, s.queue[0].due.Sub(now)
+}
+
+// run refreshes the services as they become due, until ctx is done.
+func (s *scheduler) run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+
+		due, wait := s.due(time.Now())
+		for _, entry := range due {
+			select {
+			case s.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(entry *refreshEntry) {
+				defer func() { <-s.slots }()
+				tracked, err := s.refresh(entry)
+				if !tracked {
+					s.drop(entry)
+					return
+				}
+				s.next(entry, err == nil)
+			}(entry)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// refreshQueue is a heap of entries ordered by due time.
+type refreshQueue []*refreshEntry
+
+func (q refreshQueue) Len() int           { return len(q) }
+func (q refreshQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q refreshQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *refreshQueue) Push(x interface{}) {
+	entry := x.(*refreshEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *refreshQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
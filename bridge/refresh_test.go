@@ -0,0 +1,145 @@
+package bridge
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerRefreshesOnInterval(t *testing.T) {
+	var mu sync.Mutex
+	count := 0
+	s := newScheduler(1, func(entry *refreshEntry) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		count++
+		return true, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	s.add("container", &Service{ID: "test"}, 100*time.Millisecond)
+	time.Sleep(450 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, count >= 4 && count <= 6, "refreshed %d times", count)
+}
+
+func TestSchedulerDropsUntracked(t *testing.T) {
+	done := make(chan struct{})
+	s := newScheduler(1, func(entry *refreshEntry) (bool, error) {
+		close(done)
+		return false, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	service := &Service{ID: "test"}
+	s.add("container", service, 10*time.Millisecond)
+	<-done
+	time.Sleep(10 * time.Millisecond)
+
+	s.Lock()
+	defer s.Unlock()
+	assert.Empty(t, s.entries)
+	assert.Empty(t, s.queue)
+}
+
+func TestSchedulerNext(t *testing.T) {
+	s := newScheduler(1, nil)
+	entry := &refreshEntry{service: &Service{ID: "test"}, interval: 20 * time.Second}
+
+	s.next(entry, true)
+	assert.WithinDuration(t, time.Now().Add(19*time.Second), entry.due, time.Second)
+
+	heap := s.queue
+	s.queue = heap[:0]
+	s.next(entry, false)
+	assert.WithinDuration(t, time.Now().Add(5*time.Second), entry.due, 100*time.Millisecond)
+}
+
+func TestSchedulerSpreadsNewServices(t *testing.T) {
+	s := newScheduler(1, nil)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		s.add("container", &Service{}, 10*time.Second)
+	}
+
+	var early, late int
+	for _, entry := range s.queue {
+		assert.True(t, entry.due.Before(start.Add(10*time.Second+time.Millisecond)))
+		if entry.due.Before(start.Add(5 * time.Second)) {
+			early++
+		} else {
+			late++
+		}
+	}
+	assert.NotZero(t, early)
+	assert.NotZero(t, late)
+}
+
+func TestServiceTTL(t *testing.T) {
+	bridge := &Bridge{config: Config{RefreshTtl: 30, RefreshInterval: 10}}
+
+	ttl, interval := bridge.serviceTTL("test", map[string]string{})
+	assert.Equal(t, 30, ttl)
+	assert.Equal(t, 10*time.Second, interval)
+
+	ttl, interval = bridge.serviceTTL("test", map[string]string{"ttl": "60", "ttl_refresh": "20"})
+	assert.Equal(t, 60, ttl)
+	assert.Equal(t, 20*time.Second, interval)
+
+	// a refresh interval that isn't below the ttl is halved
+	ttl, interval = bridge.serviceTTL("test", map[string]string{"ttl": "8"})
+	assert.Equal(t, 8, ttl)
+	assert.Equal(t, 4*time.Second, interval)
+
+	ttl, interval = bridge.serviceTTL("test", map[string]string{"ttl": "bad"})
+	assert.Equal(t, 30, ttl)
+
+	bridge = &Bridge{}
+	ttl, interval = bridge.serviceTTL("test", map[string]string{})
+	assert.Equal(t, 0, ttl)
+	assert.Equal(t, time.Duration(0), interval)
+}
+
+func TestDeadContainerExpires(t *testing.T) {
+	bridge := &Bridge{containers: make(map[string]*containerState)}
+	state := bridge.lockContainer("container")
+	state.services = []*Service{{ID: "test", TTL: 1}}
+	bridge.unlockContainer("container", state)
+
+	bridge.remove("container", false)
+	state.Lock()
+	assert.NotNil(t, state.dead)
+	assert.WithinDuration(t, time.Now().Add(time.Second), state.dead.Expires, 100*time.Millisecond)
+	state.Unlock()
+
+	time.Sleep(1100 * time.Millisecond)
+	bridge.mu.Lock()
+	defer bridge.mu.Unlock()
+	assert.Empty(t, bridge.containers)
+}
+
+func TestRefreshScheduled(t *testing.T) {
+	bridge := &Bridge{registry: &fakeAdapter{}, ctx: context.Background(), containers: make(map[string]*containerState)}
+	service := &Service{ID: "test"}
+	state := bridge.lockContainer("0123456789abcdef")
+	state.services = []*Service{service}
+	bridge.unlockContainer("0123456789abcdef", state)
+
+	tracked, err := bridge.refreshScheduled(&refreshEntry{containerId: "0123456789abcdef", service: service})
+	assert.True(t, tracked)
+	assert.NoError(t, err)
+
+	tracked, _ = bridge.refreshScheduled(&refreshEntry{containerId: "0123456789abcdef", service: &Service{ID: "other"}})
+	assert.False(t, tracked)
+	tracked, _ = bridge.refreshScheduled(&refreshEntry{containerId: "fedcba9876543210", service: service})
+	assert.False(t, tracked)
+}
@@ -2,21 +2,83 @@
 package bridge
 
 import (
+	"context"
+	"errors"
 	"net/url"
+	"time"
 
 	dockerapi "github.com/fsouza/go-dockerclient"
 )
 
 type AdapterFactory interface {
-	New(uri *url.URL) RegistryAdapter
+	New(uri *url.URL) (RegistryAdapter, error)
 }
 
+// SecretAdapterFactory is implemented by factories whose URIs can carry
+// secrets in query options, e.g. signing keys. The bridge leaves those
+// options out when it logs the URI.
+type SecretAdapterFactory interface {
+	AdapterFactory
+	SecretOptions() []string
+}
+
+// ErrServicesUnsupported is returned by Bridge.Services when the adapter
+// can't list the services registered in the backend.
+var ErrServicesUnsupported = errors.New("adapter can't list services")
+
+// RegistryAdapter is implemented by every backend. Each call gets a context
+// carrying the per-operation deadline, which is canceled on shutdown.
+// Adapters should return errors wrapped with Permanent when retrying the
+// call can't help, e.g. for invalid services.
+//
+// Backends supporting more than registering and deregistering services
+// implement the optional interfaces below, which the bridge detects with
+// type assertions.
 type RegistryAdapter interface {
-	Ping() error
-	Register(service *Service) error
-	Deregister(service *Service) error
-	Refresh(service *Service) error
-	Services() ([]*Service, error)
+	Ping(ctx context.Context) error
+	Register(ctx context.Context, service *Service) error
+	Deregister(ctx context.Context, service *Service) error
+}
+
+// ListRegistryAdapter is implemented by backends that can list the services
+// registered in them, which syncs compare with and -cleanup needs.
+type ListRegistryAdapter interface {
+	RegistryAdapter
+	Services(ctx context.Context) ([]*Service, error)
+}
+
+// TTLRegistryAdapter is implemented by backends that expire services after
+// their TTL, which is needed by -ttl. Refresh is called periodically to
+// keep a service registered.
+type TTLRegistryAdapter interface {
+	RegistryAdapter
+	Refresh(ctx context.Context, service *Service) error
+}
+
+// UpdateRegistryAdapter is implemented by backends that can replace a
+// registered service in place. Syncs use it for the services modified in
+// the backend instead of registering them again.
+type UpdateRegistryAdapter interface {
+	RegistryAdapter
+	Update(ctx context.Context, service *Service) error
+}
+
+// HealthRegistryAdapter is implemented by backends that can report more
+// about their health than answering Ping, e.g. whether the session or lease
+// holding the services is still alive.
+type HealthRegistryAdapter interface {
+	RegistryAdapter
+	Health(ctx context.Context) error
+}
+
+// BatchRegistryAdapter is implemented by backends that can register or
+// deregister many services in few requests, e.g. with transactions. The
+// bridge uses it on sync, cleanup and shutdown. The returned slices hold
+// the error of each service, in order, nil for the ones that succeeded.
+type BatchRegistryAdapter interface {
+	RegistryAdapter
+	RegisterBatch(ctx context.Context, services []*Service) []error
+	DeregisterBatch(ctx context.Context, services []*Service) []error
 }
 
 type Config struct {
@@ -27,6 +89,11 @@ type Config struct {
 	RefreshInterval int
 	DeregisterCheck string
 	Cleanup         bool
+	BackendTimeout  int
+	Concurrency     int
+	RateLimit       float64
+
+	DeregisterOnShutdown bool
 }
 
 type Service struct {
@@ -39,10 +106,15 @@ type Service struct {
 	TTL   int
 
 	Origin ServicePort
+
+	// refreshInterval is how often the bridge refreshes the TTL.
+	refreshInterval time.Duration
 }
 
+// DeadContainer holds the services of a stopped container until their TTL
+// runs out, in case the container is started again.
 type DeadContainer struct {
-	TTL      int
+	Expires  time.Time
 	Services []*Service
 }
 
@@ -55,5 +127,8 @@ type ServicePort struct {
 	ContainerHostname string
 	ContainerID       string
 	ContainerName     string
-	container         *dockerapi.Container
+	// Health is the status of the container's Docker health check,
+	// "starting", "healthy" or "unhealthy", or empty without one.
+	Health    string
+	container *dockerapi.Container
 }
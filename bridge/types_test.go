@@ -1,25 +1,173 @@
 package bridge
 
-import "net/url"
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+)
 
 type fakeFactory struct{}
 
-func (f *fakeFactory) New(uri *url.URL) RegistryAdapter {
+func (f *fakeFactory) New(uri *url.URL) (RegistryAdapter, error) {
 
-	return &fakeAdapter{}
+	return &fakeAdapter{}, nil
 }
 
 type fakeAdapter struct{}
 
-func (f *fakeAdapter) Ping() error {
+func (f *fakeAdapter) Ping(ctx context.Context) error {
 	return nil
 }
-func (f *fakeAdapter) Register(service *Service) error {
+func (f *fakeAdapter) Register(ctx context.Context, service *Service) error {
 	return nil
 }
-func (f *fakeAdapter) Deregister(service *Service) error {
+func (f *fakeAdapter) Deregister(ctx context.Context, service *Service) error {
 	return nil
 }
-func (f *fakeAdapter) Refresh(service *Service) error {
+func (f *fakeAdapter) Refresh(ctx context.Context, service *Service) error {
+	return nil
+}
+func (f *fakeAdapter) Services(ctx context.Context) ([]*Service, error) {
+	return nil, nil
+}
+
+type errorFactory struct{}
+
+func (f *errorFactory) New(uri *url.URL) (RegistryAdapter, error) {
+	return nil, errors.New("bad uri")
+}
+
+// failingAdapter fails every registration with err, counting the attempts.
+type failingAdapter struct {
+	fakeAdapter
+	err      error
+	attempts int
+}
+
+func (f *failingAdapter) Register(ctx context.Context, service *Service) error {
+	f.attempts++
+	return f.err
+}
+
+// hangingAdapter is a legacy adapter whose registrations never return.
+type hangingAdapter struct{}
+
+func (h *hangingAdapter) Ping() error {
+	return nil
+}
+func (h *hangingAdapter) Register(service *Service) error {
+	select {}
+}
+func (h *hangingAdapter) Deregister(service *Service) error {
+	return nil
+}
+func (h *hangingAdapter) Refresh(service *Service) error {
+	return nil
+}
+func (h *hangingAdapter) Services() ([]*Service, error) {
+	return nil, ErrServicesUnsupported
+}
+
+// legacyCoreAdapter is a legacy adapter that can't list services or
+// refresh TTLs.
+type legacyCoreAdapter struct{}
+
+func (l *legacyCoreAdapter) Ping() error {
+	return nil
+}
+func (l *legacyCoreAdapter) Register(service *Service) error {
+	return nil
+}
+func (l *legacyCoreAdapter) Deregister(service *Service) error {
+	return nil
+}
+
+// legacyListAdapter can list services but not refresh TTLs.
+type legacyListAdapter struct {
+	legacyCoreAdapter
+}
+
+func (l *legacyListAdapter) Services() ([]*Service, error) {
+	return []*Service{{ID: "a"}}, nil
+}
+
+// batchAdapter records the batches it gets. It fails services in failOnce
+// the first time only, and services in fail every time.
+type batchAdapter struct {
+	fakeAdapter
+	sync.Mutex
+	failOnce map[string]bool
+	fail     map[string]error
+	batches  [][]string
+}
+
+func (b *batchAdapter) RegisterBatch(ctx context.Context, services []*Service) []error {
+	return b.batch(services)
+}
+func (b *batchAdapter) DeregisterBatch(ctx context.Context, services []*Service) []error {
+	return b.batch(services)
+}
+func (b *batchAdapter) batch(services []*Service) []error {
+	b.Lock()
+	defer b.Unlock()
+	var ids []string
+	errs := make([]error, len(services))
+	for i, service := range services {
+		ids = append(ids, service.ID)
+		if b.failOnce[service.ID] {
+			delete(b.failOnce, service.ID)
+			errs[i] = errors.New("conflict")
+		} else if err := b.fail[service.ID]; err != nil {
+			errs[i] = err
+		}
+	}
+	b.batches = append(b.batches, ids)
+	return errs
+}
+
+// shortBatchAdapter returns fewer results than services.
+type shortBatchAdapter struct {
+	fakeAdapter
+}
+
+func (s *shortBatchAdapter) RegisterBatch(ctx context.Context, services []*Service) []error {
+	return nil
+}
+func (s *shortBatchAdapter) DeregisterBatch(ctx context.Context, services []*Service) []error {
+	return nil
+}
+
+type coreFactory struct{}
+
+func (f *coreFactory) New(uri *url.URL) (RegistryAdapter, error) {
+	return &coreAdapter{}, nil
+}
+
+// coreAdapter implements none of the optional interfaces.
+type coreAdapter struct{}
+
+func (c *coreAdapter) Ping(ctx context.Context) error {
+	return nil
+}
+func (c *coreAdapter) Register(ctx context.Context, service *Service) error {
+	return nil
+}
+func (c *coreAdapter) Deregister(ctx context.Context, service *Service) error {
+	return nil
+}
+
+// updateAdapter records the services registered and updated.
+type updateAdapter struct {
+	coreAdapter
+	registered, updated []string
+}
+
+func (u *updateAdapter) Register(ctx context.Context, service *Service) error {
+	u.registered = append(u.registered, service.ID)
+	return nil
+}
+func (u *updateAdapter) Update(ctx context.Context, service *Service) error {
+	u.updated = append(u.updated, service.ID)
 	return nil
 }
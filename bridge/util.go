@@ -1,15 +1,110 @@
 package bridge
 
 import (
+	"context"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cenkalti/backoff"
 	dockerapi "github.com/fsouza/go-dockerclient"
 )
 
-func retry(fn func() error) error {
-	return backoff.Retry(fn, backoff.NewExponentialBackOff())
+// maxRetries bounds how many times a failed registry operation is retried.
+const maxRetries = 2
+
+// retry runs fn until it succeeds, fails with a permanent error, ctx is done
+// or it failed maxRetries more times, and returns its last error.
+func retry(ctx context.Context, fn func() error) error {
+	var err error
+	policy := backoff.WithMaxRetries(backoff.NewExponentialBackOff(), maxRetries)
+	backoff.Retry(func() error {
+		err = fn()
+		if err == nil || IsPermanent(err) || ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}, backoff.WithContext(policy, ctx))
+	return err
+}
+
+// parallel calls fn with every index below count, running at most n calls
+// at once, and returns when all of them have returned.
+func parallel(n, count int, fn func(i int)) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, n)
+	for i := 0; i < count; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// serial runs functions in the background one after the other per key, in
+// the order they were submitted. Functions of different keys run
+// concurrently.
+type serial struct {
+	sync.Mutex
+	queues map[string][]func() // a key is present while its queue is running
+}
+
+func newSerial() *serial {
+	return &serial{queues: make(map[string][]func())}
+}
+
+func (s *serial) do(key string, fn func()) {
+	s.Lock()
+	queue, running := s.queues[key]
+	s.queues[key] = append(queue, fn)
+	s.Unlock()
+	if !running {
+		go s.run(key)
+	}
+}
+
+func (s *serial) run(key string) {
+	for {
+		s.Lock()
+		queue := s.queues[key]
+		if len(queue) == 0 {
+			delete(s.queues, key)
+			s.Unlock()
+			return
+		}
+		fn := queue[0]
+		s.queues[key] = queue[1:]
+		s.Unlock()
+		fn()
+	}
+}
+
+// hasService reports whether service is one of services.
+func hasService(services []*Service, service *Service) bool {
+	for _, s := range services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// maxTTL returns the longest TTL of services.
+func maxTTL(services []*Service) time.Duration {
+	var ttl int
+	for _, service := range services {
+		if service.TTL > ttl {
+			ttl = service.TTL
+		}
+	}
+	return time.Duration(ttl) * time.Second
 }
 
 func mapDefault(m map[string]string, key, default_ string) string {
@@ -88,6 +183,8 @@ func servicePort(container *dockerapi.Container, port dockerapi.Port, published
 		PortType:          ept,
 		ContainerID:       container.ID,
 		ContainerHostname: container.Config.Hostname,
+		ContainerName:     strings.TrimPrefix(container.Name, "/"),
+		Health:            container.State.Health.Status,
 		container:         container,
 	}
 }
@@ -1,11 +1,15 @@
 package consul
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/42wim/registrator-work/bridge"
 	consulapi "github.com/hashicorp/consul/api"
@@ -25,35 +29,60 @@ func (r *ConsulAdapter) interpolateService(script string, service *bridge.Servic
 
 type Factory struct{}
 
-func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
 	config := consulapi.DefaultConfig()
 	if uri.Host != "" {
 		config.Address = uri.Host
 	}
 	client, err := consulapi.NewClient(config)
 	if err != nil {
-		log.Fatal("consul: ", uri.Scheme)
+		return nil, fmt.Errorf("consul: %v", err)
 	}
-	return &ConsulAdapter{client: client}
+	adapter := &ConsulAdapter{
+		client:        client,
+		registrations: make(map[string]*consulapi.AgentServiceRegistration),
+		waitTime:      WatchWaitTime,
+	}
+	return adapter, nil
 }
 
 type ConsulAdapter struct {
+	sync.Mutex
 	client *consulapi.Client
+
+	// registrations holds every service registered through this adapter,
+	// so the watch can put them back when the agent loses or alters them.
+	registrations map[string]*consulapi.AgentServiceRegistration
+	waitTime      time.Duration // of the blocking query of the watch
+	watching      sync.Once
 }
 
 // Ping will try to connect to consul by attempting to retrieve the current leader.
-func (r *ConsulAdapter) Ping() error {
-	status := r.client.Status()
-	leader, err := status.Leader()
+// The first successful Ping starts watching the agent, until the bridge shuts
+// down.
+func (r *ConsulAdapter) Ping(ctx context.Context) error {
+	var leader string
+	err := bridge.Await(ctx, func() error {
+		var err error
+		leader, err = r.client.Status().Leader()
+		return err
+	})
 	if err != nil {
 		return err
 	}
 	log.Println("consul: current leader ", leader)
+	r.watching.Do(func() {
+		go r.watch(bridge.Lifetime(ctx))
+	})
 
 	return nil
 }
 
-func (r *ConsulAdapter) Register(service *bridge.Service) error {
+// The agent endpoints of the consul client take no context, so the calls
+// below run through bridge.Await. They take the lock inside of it, so that
+// a hung agent only blocks the adapter and not the caller.
+
+func (r *ConsulAdapter) Register(ctx context.Context, service *bridge.Service) error {
 	registration := new(consulapi.AgentServiceRegistration)
 	registration.ID = service.ID
 	registration.Name = service.Name
@@ -61,7 +90,29 @@ func (r *ConsulAdapter) Register(service *bridge.Service) error {
 	registration.Tags = service.Tags
 	registration.Address = service.IP
 	registration.Check = r.buildCheck(service)
-	return r.client.Agent().ServiceRegister(registration)
+	connect, err := r.buildConnect(service)
+	if err != nil {
+		return err
+	}
+	registration.Connect = connect
+
+	return bridge.Await(ctx, func() error {
+		r.Lock()
+		defer r.Unlock()
+		if destination := service.Attrs["connect_proxy_for"]; destination != "" {
+			registration.Kind = consulapi.ServiceKindConnectProxy
+			registration.Proxy = r.buildProxy(service, destination)
+		}
+		err := r.client.Agent().ServiceRegister(registration)
+		if err != nil {
+			return Classify(err)
+		}
+		r.registrations[service.ID] = registration
+		if registration.Kind == "" {
+			r.attachProxies(registration)
+		}
+		return nil
+	})
 }
 
 func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServiceCheck {
@@ -92,16 +143,120 @@ func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServ
 	return check
 }
 
-func (r *ConsulAdapter) Deregister(service *bridge.Service) error {
-	return r.client.Agent().ServiceDeregister(service.ID)
+// buildConnect translates the connect_* attributes of a service into its
+// Connect block, asking the agent to manage a sidecar proxy if requested.
+func (r *ConsulAdapter) buildConnect(service *bridge.Service) (*consulapi.AgentServiceConnect, error) {
+	native := service.Attrs["connect_native"] == "true"
+	sidecar := service.Attrs["connect_sidecar"] == "true"
+	if !native && !sidecar {
+		return nil, nil
+	}
+	connect := &consulapi.AgentServiceConnect{Native: native}
+	if sidecar {
+		connect.SidecarService = &consulapi.AgentServiceRegistration{
+			Proxy: &consulapi.AgentServiceConnectProxyConfig{
+				Upstreams: parseUpstreams(service.Attrs["connect_upstreams"]),
+			},
+		}
+		if port := service.Attrs["connect_sidecar_port"]; port != "" {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, bridge.Permanent(fmt.Errorf("consul: invalid sidecar port %q of %s", port, service.ID))
+			}
+			connect.SidecarService.Port = p
+		}
+	}
+	return connect, nil
 }
 
-func (r *ConsulAdapter) Refresh(service *bridge.Service) error {
-	return nil
+// buildProxy registers a sidecar container as the Connect proxy of the
+// destination service. If that service was registered on this host, the
+// proxy points at its ID and local address. Otherwise attachProxies does so
+// once it is registered. Must be called with the lock held.
+func (r *ConsulAdapter) buildProxy(service *bridge.Service, destination string) *consulapi.AgentServiceConnectProxyConfig {
+	proxy := &consulapi.AgentServiceConnectProxyConfig{
+		DestinationServiceName: destination,
+		Upstreams:              parseUpstreams(service.Attrs["connect_upstreams"]),
+	}
+	for _, registration := range r.registrations {
+		if registration.Name == destination && registration.Kind == "" {
+			setDestination(proxy, registration)
+			break
+		}
+	}
+	return proxy
 }
 
-func (r *ConsulAdapter) Services() ([]*bridge.Service, error) {
-	services, err := r.client.Agent().Services()
+// attachProxies registers the proxies of the service of destination that
+// were registered before it again, now pointing at it. Must be called with
+// the lock held.
+func (r *ConsulAdapter) attachProxies(destination *consulapi.AgentServiceRegistration) {
+	for id, registration := range r.registrations {
+		if registration.Kind != consulapi.ServiceKindConnectProxy ||
+			registration.Proxy.DestinationServiceName != destination.Name ||
+			registration.Proxy.DestinationServiceID != "" {
+			continue
+		}
+		attached := *registration
+		proxy := *registration.Proxy
+		setDestination(&proxy, destination)
+		attached.Proxy = &proxy
+		if err := r.client.Agent().ServiceRegister(&attached); err != nil {
+			log.Println("consul: failed to attach proxy:", id, err)
+			continue
+		}
+		r.registrations[id] = &attached
+		log.Println("consul: attached proxy", id, "to", destination.ID)
+	}
+}
+
+func setDestination(proxy *consulapi.AgentServiceConnectProxyConfig, destination *consulapi.AgentServiceRegistration) {
+	proxy.DestinationServiceID = destination.ID
+	proxy.LocalServiceAddress = destination.Address
+	proxy.LocalServicePort = destination.Port
+}
+
+// parseUpstreams parses a comma-separated list of <service>:<local port>.
+func parseUpstreams(value string) []consulapi.Upstream {
+	var upstreams []consulapi.Upstream
+	for _, upstream := range strings.Split(value, ",") {
+		if upstream == "" {
+			continue
+		}
+		parts := strings.SplitN(upstream, ":", 2)
+		if len(parts) != 2 {
+			log.Println("consul: ignoring upstream without local port:", upstream)
+			continue
+		}
+		port, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.Println("consul: ignoring upstream with invalid port:", upstream)
+			continue
+		}
+		upstreams = append(upstreams, consulapi.Upstream{
+			DestinationName: parts[0],
+			LocalBindPort:   port,
+		})
+	}
+	return upstreams
+}
+
+func (r *ConsulAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	return bridge.Await(ctx, func() error {
+		r.Lock()
+		defer r.Unlock()
+		delete(r.registrations, service.ID)
+		return Classify(r.client.Agent().ServiceDeregister(service.ID))
+	})
+}
+
+func (r *ConsulAdapter) Services(ctx context.Context) ([]*bridge.Service, error) {
+	var services map[string]*consulapi.AgentService
+	err := bridge.Await(ctx, func() error {
+		var err error
+		services, err = r.client.Agent().Services()
+		return err
+	})
 	if err != nil {
 		return []*bridge.Service{}, err
 	}
@@ -120,3 +275,17 @@ func (r *ConsulAdapter) Services() ([]*bridge.Service, error) {
 	}
 	return out, nil
 }
+
+// Classify marks the errors of requests Consul refused, e.g. because the
+// service is invalid or the token lacks permissions, as permanent. It is
+// shared with the consulkv adapter.
+func Classify(err error) error {
+	var code int
+	if err == nil {
+		return nil
+	}
+	if _, e := fmt.Sscanf(err.Error(), "Unexpected response code: %d", &code); e == nil && bridge.PermanentStatus(code) {
+		return bridge.Permanent(err)
+	}
+	return err
+}
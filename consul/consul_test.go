@@ -0,0 +1,77 @@
+package consul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/42wim/registrator-work/bridge"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	web   = &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080}
+	proxy = &bridge.Service{ID: "host:envoy:21000", Name: "web-proxy", IP: "10.0.0.2", Port: 21000,
+		Attrs: map[string]string{"connect_proxy_for": "web", "connect_upstreams": "db:5432"}}
+)
+
+func TestProxyDestination(t *testing.T) {
+	r, f := newAdapter(t)
+	ctx := context.Background()
+	assert.NoError(t, r.Register(ctx, web))
+
+	assert.NoError(t, r.Register(ctx, proxy))
+
+	registration := f.registrations["host:envoy:21000"]
+	assert.Equal(t, consulapi.ServiceKindConnectProxy, registration.Kind)
+	assert.Equal(t, &consulapi.AgentServiceConnectProxyConfig{
+		DestinationServiceName: "web",
+		DestinationServiceID:   "host:web:80",
+		LocalServiceAddress:    "10.0.0.2",
+		LocalServicePort:       8080,
+		Upstreams:              []consulapi.Upstream{{DestinationName: "db", LocalBindPort: 5432}},
+	}, registration.Proxy)
+}
+
+func TestProxyAttachedToLaterDestination(t *testing.T) {
+	r, f := newAdapter(t)
+	ctx := context.Background()
+	assert.NoError(t, r.Register(ctx, proxy))
+	assert.Empty(t, f.registrations["host:envoy:21000"].Proxy.DestinationServiceID)
+
+	assert.NoError(t, r.Register(ctx, web))
+
+	assert.Equal(t, []string{"host:envoy:21000", "host:web:80", "host:envoy:21000"}, f.registered)
+	registration := f.registrations["host:envoy:21000"]
+	assert.Equal(t, "host:web:80", registration.Proxy.DestinationServiceID)
+	assert.Equal(t, 8080, registration.Proxy.LocalServicePort)
+	assert.Equal(t, registration.Proxy, r.registrations["host:envoy:21000"].Proxy)
+
+	// attached proxies are left alone
+	f.registered = nil
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "host:web:81", Name: "web", IP: "10.0.0.2", Port: 8081}))
+	assert.Equal(t, []string{"host:web:81"}, f.registered)
+}
+
+func TestSidecar(t *testing.T) {
+	r, f := newAdapter(t)
+	service := &bridge.Service{ID: "host:web:80", Name: "web", Port: 8080,
+		Attrs: map[string]string{"connect_sidecar": "true", "connect_sidecar_port": "21000", "connect_upstreams": "db:5432,bogus"}}
+
+	assert.NoError(t, r.Register(context.Background(), service))
+
+	connect := f.registrations["host:web:80"].Connect
+	assert.Equal(t, 21000, connect.SidecarService.Port)
+	assert.Equal(t, []consulapi.Upstream{{DestinationName: "db", LocalBindPort: 5432}}, connect.SidecarService.Proxy.Upstreams)
+}
+
+func TestInvalidSidecarPortPermanent(t *testing.T) {
+	r, f := newAdapter(t)
+	service := &bridge.Service{ID: "host:web:80", Name: "web", Port: 8080,
+		Attrs: map[string]string{"connect_sidecar": "true", "connect_sidecar_port": "auto"}}
+
+	err := r.Register(context.Background(), service)
+
+	assert.True(t, bridge.IsPermanent(err))
+	assert.Empty(t, f.registered)
+}
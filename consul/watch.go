@@ -0,0 +1,197 @@
+package consul
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/cenkalti/backoff"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// WatchWaitTime bounds a single blocking query, so the agent's service list
+// is checked at least this often even if the catalog never changes.
+const WatchWaitTime = 5 * time.Minute
+
+// WatchTimeout bounds the other requests of the watch, so that a hung agent
+// can't stall it.
+const WatchTimeout = 30 * time.Second
+
+// watchStats counts external changes to registered services. It is exported
+// through expvar as "consul_watch".
+var watchStats = expvar.NewMap("consul_watch")
+
+// watch runs a blocking query on the catalog entry of the agent's node and,
+// whenever it returns, compares the agent's service list with the services
+// registered through this adapter, until ctx is canceled.
+func (r *ConsulAdapter) watch(ctx context.Context) {
+	var node string
+	var index uint64
+
+	wait := backoff.NewExponentialBackOff()
+	wait.MaxElapsedTime = 0
+	retry := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait.NextBackOff()):
+			return true
+		}
+	}
+
+	for ctx.Err() == nil {
+		if node == "" {
+			err := r.await(ctx, func() error {
+				var err error
+				node, err = r.client.Agent().NodeName()
+				return err
+			})
+			if err != nil {
+				watchStats.Add("errors", 1)
+				log.Println("consul: watch unable to get node name:", err)
+				if !retry() {
+					return
+				}
+				continue
+			}
+		}
+
+		opts := &consulapi.QueryOptions{WaitIndex: index, WaitTime: r.waitTime}
+		_, meta, err := r.client.Catalog().Node(node, opts.WithContext(ctx))
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// the agent may have restarted, possibly under a new name
+			watchStats.Add("errors", 1)
+			log.Println("consul: watch failed:", err)
+			node, index = "", 0
+			if !retry() {
+				return
+			}
+			continue
+		}
+		wait.Reset()
+
+		if meta.LastIndex < index {
+			// the index went backwards, e.g. after a state loss
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+
+		r.reconcile(ctx)
+	}
+}
+
+// reconcile re-registers every tracked service that the agent no longer
+// knows about or that was modified outside of registrator. The lock is only
+// held to copy the registrations, not across requests to the agent.
+func (r *ConsulAdapter) reconcile(ctx context.Context) {
+	r.Lock()
+	registrations := make(map[string]*consulapi.AgentServiceRegistration, len(r.registrations))
+	for id, registration := range r.registrations {
+		registrations[id] = registration
+	}
+	r.Unlock()
+
+	var services map[string]*consulapi.AgentService
+	err := r.await(ctx, func() error {
+		var err error
+		services, err = r.client.Agent().Services()
+		return err
+	})
+	if err != nil {
+		watchStats.Add("errors", 1)
+		log.Println("consul: watch unable to list agent services:", err)
+		return
+	}
+	for id, registration := range registrations {
+		service, ok := services[id]
+		switch {
+		case !ok:
+			watchStats.Add("missing", 1)
+			log.Println("consul: service disappeared from agent:", id)
+		case serviceModified(registration, service):
+			watchStats.Add("modified", 1)
+			log.Println("consul: service modified externally:", id)
+		default:
+			continue
+		}
+		go r.reregister(ctx, registration)
+	}
+}
+
+// reregister puts registration back right away, with exponential backoff.
+// It gives up as soon as the service is deregistered or registered again by
+// the bridge, or ctx is canceled.
+func (r *ConsulAdapter) reregister(ctx context.Context, registration *consulapi.AgentServiceRegistration) {
+	err := backoff.Retry(func() error {
+		if !r.tracks(registration) {
+			return nil
+		}
+		return r.await(ctx, func() error {
+			return r.client.Agent().ServiceRegister(registration)
+		})
+	}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+	if err != nil {
+		watchStats.Add("errors", 1)
+		log.Println("consul: re-register failed:", registration.ID, err)
+		return
+	}
+	if !r.tracks(registration) {
+		// deregistered or replaced meanwhile, the bridge's request may have
+		// reached the agent first
+		r.undo(ctx, registration)
+		return
+	}
+	watchStats.Add("reregistered", 1)
+	log.Println("consul: re-registered:", registration.ID)
+}
+
+// undo restores what the bridge asked for after reregister raced with it:
+// the current registration of the service, or none.
+func (r *ConsulAdapter) undo(ctx context.Context, registration *consulapi.AgentServiceRegistration) {
+	r.Lock()
+	current := r.registrations[registration.ID]
+	r.Unlock()
+	err := r.await(ctx, func() error {
+		if current != nil {
+			return r.client.Agent().ServiceRegister(current)
+		}
+		return r.client.Agent().ServiceDeregister(registration.ID)
+	})
+	if err != nil {
+		watchStats.Add("errors", 1)
+		log.Println("consul: watch unable to restore:", registration.ID, err)
+	}
+}
+
+// tracks reports whether registration is still the one of its service.
+func (r *ConsulAdapter) tracks(registration *consulapi.AgentServiceRegistration) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.registrations[registration.ID] == registration
+}
+
+// await runs a request of the watch, bounded by WatchTimeout.
+func (r *ConsulAdapter) await(ctx context.Context, fn func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, WatchTimeout)
+	defer cancel()
+	return bridge.Await(ctx, fn)
+}
+
+func serviceModified(registration *consulapi.AgentServiceRegistration, service *consulapi.AgentService) bool {
+	if registration.Name != service.Service ||
+		registration.Port != service.Port ||
+		registration.Address != service.Address {
+		return true
+	}
+	if len(registration.Tags) == 0 && len(service.Tags) == 0 {
+		return false
+	}
+	return !reflect.DeepEqual(registration.Tags, service.Tags)
+}
@@ -0,0 +1,230 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAgent implements the parts of the agent API the adapter uses.
+type fakeAgent struct {
+	sync.Mutex
+	services      map[string]*consulapi.AgentService
+	registrations map[string]*consulapi.AgentServiceRegistration
+	registered    []string      // IDs in the order they were registered
+	index         uint64        // raft index of the node, bumped on changes
+	hang          chan struct{} // if set, listing services waits for it
+}
+
+func (f *fakeAgent) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/v1/catalog/node/"):
+		f.node(w, req)
+		return
+	case req.URL.Path == "/v1/agent/services" && f.hang != nil:
+		<-f.hang
+	}
+	f.Lock()
+	defer f.Unlock()
+	switch {
+	case req.URL.Path == "/v1/status/leader":
+		w.Write([]byte(`"10.0.0.1:8300"`))
+	case req.URL.Path == "/v1/agent/self":
+		w.Write([]byte(`{"Config":{"NodeName":"node1"}}`))
+	case req.URL.Path == "/v1/agent/services":
+		json.NewEncoder(w).Encode(f.services)
+	case req.URL.Path == "/v1/agent/service/register":
+		var registration consulapi.AgentServiceRegistration
+		if err := json.NewDecoder(req.Body).Decode(&registration); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.services[registration.ID] = &consulapi.AgentService{
+			ID:      registration.ID,
+			Service: registration.Name,
+			Port:    registration.Port,
+			Address: registration.Address,
+			Tags:    registration.Tags,
+		}
+		f.registrations[registration.ID] = &registration
+		f.registered = append(f.registered, registration.ID)
+		f.index++
+	case strings.HasPrefix(req.URL.Path, "/v1/agent/service/deregister/"):
+		delete(f.services, strings.TrimPrefix(req.URL.Path, "/v1/agent/service/deregister/"))
+		f.index++
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// node answers a blocking query on the catalog entry of the node, once its
+// index passed the one asked for or the wait time is up.
+func (f *fakeAgent) node(w http.ResponseWriter, req *http.Request) {
+	index, _ := strconv.ParseUint(req.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(req.URL.Query().Get("wait"))
+	for deadline := time.Now().Add(wait); ; time.Sleep(5 * time.Millisecond) {
+		f.Lock()
+		current := f.index
+		f.Unlock()
+		if current > index || time.Now().After(deadline) || req.Context().Err() != nil {
+			w.Header().Set("X-Consul-Index", strconv.FormatUint(current, 10))
+			w.Write([]byte(`{"Node":{"Node":"node1"},"Services":{}}`))
+			return
+		}
+	}
+}
+
+// registeredIDs waits for n registrations and returns their IDs.
+func (f *fakeAgent) registeredIDs(t *testing.T, n int) []string {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		f.Lock()
+		registered := append([]string(nil), f.registered...)
+		f.Unlock()
+		if len(registered) >= n {
+			return registered
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d registrations", len(registered), n)
+		}
+	}
+}
+
+// remove drops a service as if the agent lost it, returning whether it was
+// there.
+func (f *fakeAgent) remove(id string) bool {
+	f.Lock()
+	defer f.Unlock()
+	_, ok := f.services[id]
+	delete(f.services, id)
+	f.index++
+	return ok
+}
+
+func (f *fakeAgent) has(id string) bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.services[id] != nil
+}
+
+// newAdapter returns an adapter talking to a fake agent.
+func newAdapter(t *testing.T) (*ConsulAdapter, *fakeAgent) {
+	f := &fakeAgent{
+		services:      make(map[string]*consulapi.AgentService),
+		registrations: make(map[string]*consulapi.AgentServiceRegistration),
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	client, err := consulapi.NewClient(&consulapi.Config{Address: server.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ConsulAdapter{
+		client:        client,
+		registrations: make(map[string]*consulapi.AgentServiceRegistration),
+		waitTime:      WatchWaitTime,
+	}, f
+}
+
+func TestReconcile(t *testing.T) {
+	r, f := newAdapter(t)
+	ctx := context.Background()
+	for _, service := range []*bridge.Service{
+		{ID: "lost", Name: "web", IP: "10.0.0.2", Port: 80},
+		{ID: "modified", Name: "web", IP: "10.0.0.2", Port: 81, Tags: []string{"a"}},
+		{ID: "unchanged", Name: "web", IP: "10.0.0.2", Port: 82},
+	} {
+		assert.NoError(t, r.Register(ctx, service))
+	}
+	f.remove("lost")
+	f.Lock()
+	f.services["modified"].Tags = []string{"b"}
+	f.registered = nil
+	f.Unlock()
+
+	r.reconcile(ctx)
+
+	assert.ElementsMatch(t, []string{"lost", "modified"}, f.registeredIDs(t, 2))
+	f.Lock()
+	assert.Equal(t, 80, f.services["lost"].Port)
+	assert.Equal(t, []string{"a"}, f.services["modified"].Tags)
+	f.registered = nil
+	f.Unlock()
+
+	// deregistered services are left alone
+	assert.NoError(t, r.Deregister(ctx, &bridge.Service{ID: "unchanged"}))
+	f.remove("unchanged")
+	r.reconcile(ctx)
+	time.Sleep(50 * time.Millisecond)
+	f.Lock()
+	assert.Empty(t, f.registered)
+	f.Unlock()
+}
+
+func TestReconcileUnlocked(t *testing.T) {
+	r, f := newAdapter(t)
+	ctx := context.Background()
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80}))
+	f.hang = make(chan struct{})
+	defer close(f.hang)
+
+	go r.reconcile(ctx)
+	time.Sleep(20 * time.Millisecond)
+
+	// a hung agent doesn't block the bridge's requests
+	deregistered := make(chan error)
+	go func() { deregistered <- r.Deregister(ctx, &bridge.Service{ID: "web1"}) }()
+	select {
+	case err := <-deregistered:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("deregister blocked by reconcile")
+	}
+}
+
+func TestReregisterGivesUp(t *testing.T) {
+	r, f := newAdapter(t)
+	ctx := context.Background()
+	service := &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80}
+	assert.NoError(t, r.Register(ctx, service))
+	registration := r.registrations["web1"]
+	assert.NoError(t, r.Deregister(ctx, service))
+	f.registered = nil
+
+	r.reregister(ctx, registration)
+
+	assert.Empty(t, f.registered)
+	assert.False(t, f.has("web1"))
+}
+
+func TestWatchReregisters(t *testing.T) {
+	r, f := newAdapter(t)
+	r.waitTime = time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, r.Ping(ctx))
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80}))
+
+	f.remove("web1")
+	for deadline := time.Now().Add(5 * time.Second); !f.has("web1"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("service not registered again")
+		}
+	}
+
+	// stopped once the bridge shuts down
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	f.remove("web1")
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, f.has("web1"))
+}
@@ -0,0 +1,246 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/42wim/registrator-work/bridge"
+	consuladapter "github.com/42wim/registrator-work/consul"
+	"github.com/42wim/registrator-work/kv"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// MaxTxnOps is the most operations Consul accepts in a transaction.
+const MaxTxnOps = 64
+
+// txnItem holds the operations writing or deleting the keys of one service.
+type txnItem struct {
+	index int // of the service in the batch
+	ops   consulapi.TxnOps
+}
+
+// RegisterBatch writes the keys of services in as few transactions as
+// possible. Keys of services with a TTL are locked with the session of their
+// TTL.
+func (r *ConsulKVAdapter) RegisterBatch(ctx context.Context, services []*bridge.Service) []error {
+	errs := make([]error, len(services))
+	sessions := make([]string, len(services))
+	r.Lock()
+	defer r.Unlock()
+
+	failed := make(map[int]error) // TTL -> error creating its session
+	items := make([]txnItem, 0, len(services))
+	for i, service := range services {
+		err := failed[service.TTL]
+		if err == nil {
+			if sessions[i], err = r.session(ctx, service.TTL); err != nil {
+				err = consuladapter.Classify(err)
+				failed[service.TTL] = err
+			}
+		}
+		var ops consulapi.TxnOps
+		if err == nil {
+			ops, err = r.registerOps(service, sessions[i])
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		items = append(items, txnItem{index: i, ops: ops})
+	}
+
+	r.txn(ctx, items, errs)
+	for i, service := range services {
+		if errs[i] != nil {
+			log.Println("consulkv: failed to register service:", service.ID, errs[i])
+		} else if service.TTL > 0 {
+			r.acquired[service.ID] = sessions[i]
+		}
+	}
+	return errs
+}
+
+// DeregisterBatch deletes the keys of services in as few transactions as
+// possible.
+func (r *ConsulKVAdapter) DeregisterBatch(ctx context.Context, services []*bridge.Service) []error {
+	errs := make([]error, len(services))
+	items := make([]txnItem, 0, len(services))
+	for i, service := range services {
+		ops, err := r.deregisterOps(service)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		items = append(items, txnItem{index: i, ops: ops})
+	}
+
+	r.txn(ctx, items, errs)
+	r.Lock()
+	defer r.Unlock()
+	for i, service := range services {
+		if errs[i] != nil {
+			log.Println("consulkv: failed to deregister service:", service.ID, errs[i])
+		} else {
+			delete(r.acquired, service.ID)
+		}
+	}
+	return errs
+}
+
+// Update replaces the keys of service in one transaction, so that with the
+// env format the keys of attributes it no longer has are deleted.
+func (r *ConsulKVAdapter) Update(ctx context.Context, service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	del, err := r.deregisterOps(service)
+	var session string
+	if err == nil {
+		if session, err = r.session(ctx, service.TTL); err != nil {
+			err = consuladapter.Classify(err)
+		}
+	}
+	if err == nil {
+		var set consulapi.TxnOps
+		if set, err = r.registerOps(service, session); err == nil {
+			errs := make([]error, 1)
+			r.txn(ctx, []txnItem{{ops: append(del, set...)}}, errs)
+			err = errs[0]
+		}
+	}
+	if err != nil {
+		log.Println("consulkv: failed to update service:", err)
+		return err
+	}
+	if service.TTL > 0 {
+		r.acquired[service.ID] = session
+	}
+	return nil
+}
+
+// Health reports an error once a session holding the keys of services with
+// a TTL expired.
+func (r *ConsulKVAdapter) Health(ctx context.Context) error {
+	r.Lock()
+	sessions := make([]string, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s.id)
+	}
+	r.Unlock()
+	for _, session := range sessions {
+		entry, _, err := r.client.Session().Info(session, (&consulapi.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return fmt.Errorf("consulkv: session %s expired", session)
+		}
+	}
+	return nil
+}
+
+// registerOps returns the operations writing the keys of service, locked
+// with session unless it is "".
+func (r *ConsulKVAdapter) registerOps(service *bridge.Service, session string) (consulapi.TxnOps, error) {
+	pairs, err := r.servicePairs(service)
+	if err != nil {
+		return nil, bridge.Permanent(err)
+	}
+	ops := make(consulapi.TxnOps, 0, len(pairs))
+	for _, pair := range pairs {
+		op := &consulapi.KVTxnOp{Verb: consulapi.KVSet, Key: pair.Key, Value: pair.Value}
+		if session != "" {
+			op.Verb = consulapi.KVLock
+			op.Session = session
+		}
+		ops = append(ops, &consulapi.TxnOp{KV: op})
+	}
+	return ops, nil
+}
+
+// deregisterOps returns the operations deleting the keys of service.
+func (r *ConsulKVAdapter) deregisterOps(service *bridge.Service) (consulapi.TxnOps, error) {
+	paths, err := r.servicePaths(service)
+	if err != nil {
+		return nil, bridge.Permanent(err)
+	}
+	ops := make(consulapi.TxnOps, 0, len(paths))
+	for _, path := range paths {
+		op := &consulapi.KVTxnOp{Verb: consulapi.KVDelete, Key: path}
+		if r.format == kv.FormatEnv {
+			op.Verb = consulapi.KVDeleteTree
+			op.Key = path + "/"
+		}
+		ops = append(ops, &consulapi.TxnOp{KV: op})
+	}
+	return ops, nil
+}
+
+// txn runs the operations of items in transactions of at most MaxTxnOps
+// operations, never splitting the operations of an item. When operations
+// fail, the errors are set for their items and the transaction is run
+// again without them.
+func (r *ConsulKVAdapter) txn(ctx context.Context, items []txnItem, errs []error) {
+	opts := (&consulapi.QueryOptions{}).WithContext(ctx)
+	for len(items) > 0 {
+		var chunk []txnItem
+		var ops consulapi.TxnOps
+		for len(items) > 0 {
+			item := items[0]
+			if len(item.ops) > MaxTxnOps {
+				errs[item.index] = bridge.Permanent(fmt.Errorf("consulkv: %d keys exceed the %d operations of a transaction", len(item.ops), MaxTxnOps))
+				items = items[1:]
+				continue
+			}
+			if len(ops)+len(item.ops) > MaxTxnOps {
+				break
+			}
+			chunk = append(chunk, item)
+			ops = append(ops, item.ops...)
+			items = items[1:]
+		}
+
+		for len(chunk) > 0 {
+			ok, res, _, err := r.client.Txn().Txn(ops, opts)
+			if err != nil {
+				for _, item := range chunk {
+					errs[item.index] = consuladapter.Classify(err)
+				}
+				break
+			}
+			if ok {
+				break
+			}
+
+			// map the failed operations back to their items, and retry
+			// the others, which were rolled back
+			failed := make(map[int]bool)
+			for _, e := range res.Errors {
+				offset := 0
+				for _, item := range chunk {
+					if e.OpIndex < offset+len(item.ops) {
+						errs[item.index] = fmt.Errorf("consulkv: %s", e.What)
+						failed[item.index] = true
+						break
+					}
+					offset += len(item.ops)
+				}
+			}
+			if len(failed) == 0 {
+				for _, item := range chunk {
+					errs[item.index] = fmt.Errorf("consulkv: transaction rolled back")
+				}
+				break
+			}
+			rest := chunk[:0]
+			ops = nil
+			for _, item := range chunk {
+				if !failed[item.index] {
+					rest = append(rest, item)
+					ops = append(ops, item.ops...)
+				}
+			}
+			chunk = rest
+		}
+	}
+}
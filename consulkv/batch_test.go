@@ -0,0 +1,90 @@
+package consul
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/42wim/registrator-work/bridge"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterBatch(t *testing.T) {
+	ctx := context.Background()
+	r, f := newAdapter(t, "consulkv:///services")
+	services := make([]*bridge.Service, 100)
+	for i := range services {
+		services[i] = &bridge.Service{ID: "host:web:" + strconv.Itoa(i), Name: "web", IP: "10.0.0.2", Port: 8000 + i}
+	}
+
+	errs := r.RegisterBatch(ctx, services)
+
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Len(t, f.keys(), 100)
+	assert.Equal(t, 2, f.txns)
+
+	f.txns = 0
+	errs = r.DeregisterBatch(ctx, services)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, f.keys())
+	assert.Equal(t, 2, f.txns)
+}
+
+func TestRegisterBatchFailedItem(t *testing.T) {
+	ctx := context.Background()
+	r, f := newAdapter(t, "consulkv:///services")
+	f.sessions["other"] = &consulapi.SessionEntry{ID: "other", Name: "someone else", Node: "node1", TTL: "30s"}
+	f.kv["services/web/host:web:81"] = &consulapi.KVPair{Key: "services/web/host:web:81", Session: "other"}
+	services := []*bridge.Service{
+		{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080, TTL: 30},
+		{ID: "host:web:81", Name: "web", IP: "10.0.0.2", Port: 8081, TTL: 30},
+		{ID: "host:db:5432", Name: "db", IP: "10.0.0.3", Port: 5432},
+	}
+
+	errs := r.RegisterBatch(ctx, services)
+
+	// the transaction is run again without the failed service
+	assert.NoError(t, errs[0])
+	assert.EqualError(t, errs[1], "consulkv: services/web/host:web:81 is locked by other")
+	assert.NoError(t, errs[2])
+	assert.Equal(t, 2, f.txns)
+	assert.Equal(t, "30s", f.session("services/web/host:web:80").TTL)
+	assert.Nil(t, f.session("services/db/host:db:5432"))
+	assert.Equal(t, f.session("services/web/host:web:80").ID, r.acquired["host:web:80"])
+	assert.NotContains(t, r.acquired, "host:web:81")
+}
+
+func TestRegisterBatchTooManyKeys(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newAdapter(t, "consulkv:///services?format=env")
+	attrs := make(map[string]string)
+	for i := 0; i < MaxTxnOps; i++ {
+		attrs["a"+strconv.Itoa(i)] = "x"
+	}
+
+	errs := r.RegisterBatch(ctx, []*bridge.Service{{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080, Attrs: attrs}})
+
+	assert.True(t, bridge.IsPermanent(errs[0]))
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	r, f := newAdapter(t, "consulkv:///services?format=env")
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080,
+		Attrs: map[string]string{"region": "eu", "zone": "a"}}
+	assert.NoError(t, r.Register(ctx, service))
+	f.txns = 0
+
+	updated := *service
+	updated.Attrs = map[string]string{"region": "us"}
+	assert.NoError(t, r.Update(ctx, &updated))
+
+	assert.Equal(t, 1, f.txns)
+	assert.Equal(t, "us", f.value("services/web/host:web:80/attrs/region"))
+	assert.NotContains(t, f.keys(), "services/web/host:web:80/attrs/zone")
+}
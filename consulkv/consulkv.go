@@ -1,42 +1,89 @@
 package consul
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
-	"net"
 	"net/url"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/42wim/registrator-work/bridge"
+	consuladapter "github.com/42wim/registrator-work/consul"
+	"github.com/42wim/registrator-work/kv"
 	consulapi "github.com/hashicorp/consul/api"
 )
 
+// MinSessionTTL is the shortest session TTL Consul accepts.
+const MinSessionTTL = 10
+
 func init() {
 	bridge.Register(new(Factory), "consulkv")
 }
 
 type Factory struct{}
 
-func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
+	if len(uri.Path) < 2 {
+		return nil, errors.New("consulkv: prefix required e.g.: consulkv://<host>/<prefix>")
+	}
 	config := consulapi.DefaultConfig()
 	if uri.Host != "" {
 		config.Address = uri.Host
 	}
 	client, err := consulapi.NewClient(config)
 	if err != nil {
-		log.Fatal("consulkv: ", uri.Scheme)
+		return nil, fmt.Errorf("consulkv: %v", err)
 	}
-	return &ConsulKVAdapter{client: client, path: uri.Path}
+	format, err := kv.ParseFormat(uri)
+	if err != nil {
+		return nil, fmt.Errorf("consulkv: %v", err)
+	}
+	layout, err := kv.ParseLayout(uri)
+	if err != nil {
+		return nil, fmt.Errorf("consulkv: %v", err)
+	}
+	if err := format.Check(layout); err != nil {
+		return nil, fmt.Errorf("consulkv: %v", err)
+	}
+	return &ConsulKVAdapter{
+		client:   client,
+		path:     uri.Path,
+		format:   format,
+		layout:   layout,
+		sessions: make(map[int]*session),
+		acquired: make(map[string]string),
+	}, nil
 }
 
 type ConsulKVAdapter struct {
+	sync.Mutex
 	client *consulapi.Client
 	path   string
+	format kv.Format
+	layout *kv.Layout
+
+	// sessions hold the keys written with a TTL, one per TTL, so that they
+	// are deleted by Consul once it is no longer renewed.
+	sessions map[int]*session
+	acquired map[string]string // service ID -> session its keys were acquired with
+}
+
+type session struct {
+	id      string
+	renewed time.Time
 }
 
 // Ping will try to connect to consul by attempting to retrieve the current leader.
-func (r *ConsulKVAdapter) Ping() error {
-	status := r.client.Status()
-	leader, err := status.Leader()
+func (r *ConsulKVAdapter) Ping(ctx context.Context) error {
+	var leader string
+	err := bridge.Await(ctx, func() error {
+		var err error
+		leader, err = r.client.Status().Leader()
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -45,30 +92,236 @@ func (r *ConsulKVAdapter) Ping() error {
 	return nil
 }
 
-func (r *ConsulKVAdapter) Register(service *bridge.Service) error {
-	path := r.path[1:] + "/" + service.Name + "/" + service.ID
-	port := strconv.Itoa(service.Port)
-	addr := net.JoinHostPort(service.IP, port)
-	_, err := r.client.KV().Put(&consulapi.KVPair{Key: path, Value: []byte(addr)}, nil)
+func (r *ConsulKVAdapter) Register(ctx context.Context, service *bridge.Service) error {
+	pairs, err := r.servicePairs(service)
 	if err != nil {
 		log.Println("consulkv: failed to register service:", err)
+		return bridge.Permanent(err)
 	}
-	return err
+
+	if service.TTL > 0 {
+		r.Lock()
+		err = r.acquire(ctx, service.ID, pairs, service.TTL)
+		r.Unlock()
+	} else {
+		opts := (&consulapi.WriteOptions{}).WithContext(ctx)
+		for _, pair := range pairs {
+			if _, err = r.client.KV().Put(pair, opts); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Println("consulkv: failed to register service:", err)
+	}
+	return consuladapter.Classify(err)
 }
 
-func (r *ConsulKVAdapter) Deregister(service *bridge.Service) error {
-	path := r.path[1:] + "/" + service.Name + "/" + service.ID
-	_, err := r.client.KV().Delete(path, nil)
+func (r *ConsulKVAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	paths, err := r.servicePaths(service)
 	if err != nil {
 		log.Println("consulkv: failed to deregister service:", err)
+		return bridge.Permanent(err)
+	}
+	r.Lock()
+	delete(r.acquired, service.ID)
+	r.Unlock()
+	opts := (&consulapi.WriteOptions{}).WithContext(ctx)
+	for _, path := range paths {
+		if r.format == kv.FormatEnv {
+			_, err = r.client.KV().DeleteTree(path+"/", opts)
+		} else {
+			_, err = r.client.KV().Delete(path, opts)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Println("consulkv: failed to deregister service:", err)
+	}
+	return consuladapter.Classify(err)
+}
+
+// Refresh renews the session of the service's TTL, which holds its keys.
+// If the session expired in the meantime, the keys are written again under
+// a new one.
+func (r *ConsulKVAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	if service.TTL == 0 {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	// services sharing the session are refreshed close to each other, renew
+	// it at most once a second
+	s := r.sessions[service.TTL]
+	if s != nil && time.Since(s.renewed) > time.Second {
+		entry, _, err := r.client.Session().Renew(s.id, (&consulapi.WriteOptions{}).WithContext(ctx))
+		if err != nil {
+			log.Println("consulkv: failed to renew session:", err)
+			return consuladapter.Classify(err)
+		}
+		if entry == nil {
+			log.Println("consulkv: session expired:", s.id)
+			delete(r.sessions, service.TTL)
+			s = nil
+		} else {
+			s.renewed = time.Now()
+		}
+	}
+
+	if s != nil && r.acquired[service.ID] == s.id {
+		return nil
+	}
+	pairs, err := r.servicePairs(service)
+	if err != nil {
+		log.Println("consulkv: failed to register service:", err)
+		return bridge.Permanent(err)
+	}
+	if err = r.acquire(ctx, service.ID, pairs, service.TTL); err != nil {
+		log.Println("consulkv: failed to register service:", err)
+	}
+	return consuladapter.Classify(err)
+}
+
+func (r *ConsulKVAdapter) Services(ctx context.Context) ([]*bridge.Service, error) {
+	prefix := r.path[1:] + "/"
+	pairs, _, err := r.client.KV().List(prefix, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	values := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		values[pair.Key] = string(pair.Value)
+	}
+	return r.format.Parse(r.path[1:], r.layout, values, func(key string, err error) {
+		log.Println("consulkv: skipping", key+":", err)
+	}), nil
+}
+
+// servicePaths returns every key the service is stored at.
+func (r *ConsulKVAdapter) servicePaths(service *bridge.Service) ([]string, error) {
+	keys, err := r.layout.Keys(service)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = r.path[1:] + "/" + key
+	}
+	return keys, nil
+}
+
+// servicePairs encodes service in the configured format at all its keys.
+func (r *ConsulKVAdapter) servicePairs(service *bridge.Service) ([]*consulapi.KVPair, error) {
+	paths, err := r.servicePaths(service)
+	if err != nil {
+		return nil, err
+	}
+	values, err := r.format.Encode(service)
+	if err != nil {
+		return nil, err
+	}
+	pairs := make([]*consulapi.KVPair, 0, len(paths)*len(values))
+	for _, path := range paths {
+		for key, value := range values {
+			if key != "" {
+				key = path + "/" + key
+			} else {
+				key = path
+			}
+			pairs = append(pairs, &consulapi.KVPair{Key: key, Value: []byte(value)})
+		}
 	}
-	return err
+	return pairs, nil
 }
 
-func (r *ConsulKVAdapter) Refresh(service *bridge.Service) error {
+// acquire writes the pairs of the service as held by the session of ttl.
+// Must be called with the lock held.
+func (r *ConsulKVAdapter) acquire(ctx context.Context, id string, pairs []*consulapi.KVPair, ttl int) error {
+	session, err := r.session(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	opts := (&consulapi.WriteOptions{}).WithContext(ctx)
+	for _, pair := range pairs {
+		pair.Session = session
+		ok, _, err := r.client.KV().Acquire(pair, opts)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("consulkv: %s is held by another session", pair.Key)
+		}
+	}
+	r.acquired[id] = session
 	return nil
 }
 
-func (r *ConsulKVAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+// session returns the ID of the session of ttl, creating it first if needed.
+// Without a TTL there is no session and it returns "". Must be called with
+// the lock held.
+func (r *ConsulKVAdapter) session(ctx context.Context, ttl int) (string, error) {
+	if ttl == 0 {
+		return "", nil
+	}
+	if s := r.sessions[ttl]; s != nil {
+		return s.id, nil
+	}
+	s, err := r.createSession(ctx, ttl)
+	if err != nil {
+		return "", err
+	}
+	return s.id, nil
+}
+
+// createSession creates the session of ttl, which deletes its keys when it
+// expires. Sessions of the same TTL left behind by a previous registrator on
+// this host are destroyed first, so their keys can be acquired again. Must
+// be called with the lock held.
+func (r *ConsulKVAdapter) createSession(ctx context.Context, ttl int) (*session, error) {
+	name := "registrator:" + bridge.Hostname + ":" + r.path + ":" + strconv.Itoa(ttl)
+	key := ttl
+	if ttl < MinSessionTTL {
+		log.Printf("consulkv: ttl %ds is below the consul minimum, using %ds", ttl, MinSessionTTL)
+		ttl = MinSessionTTL
+	}
+
+	var node string
+	err := bridge.Await(ctx, func() error {
+		var err error
+		node, err = r.client.Agent().NodeName()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	opts := (&consulapi.WriteOptions{}).WithContext(ctx)
+	sessions, _, err := r.client.Session().Node(node, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	for _, stale := range sessions {
+		if stale.Name == name {
+			log.Println("consulkv: destroying stale session:", stale.ID)
+			if _, err := r.client.Session().Destroy(stale.ID, opts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	id, _, err := r.client.Session().Create(&consulapi.SessionEntry{
+		Name:     name,
+		TTL:      strconv.Itoa(ttl) + "s",
+		Behavior: consulapi.SessionBehaviorDelete,
+		// keys must be acquirable again right after an expiry
+		LockDelay: time.Millisecond,
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("consulkv: created session:", id)
+	s := &session{id: id, renewed: time.Now()}
+	r.sessions[key] = s
+	return s, nil
 }
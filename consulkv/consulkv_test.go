@@ -0,0 +1,388 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConsul implements the parts of the KV, session and transaction API the
+// adapter uses. Keys held by a session are deleted when it is destroyed or
+// expires, as with the delete behavior.
+type fakeConsul struct {
+	sync.Mutex
+	kv       map[string]*consulapi.KVPair
+	sessions map[string]*consulapi.SessionEntry
+	created  int // sessions created so far
+	txns     int // transactions run so far
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	path := req.URL.Path
+	switch {
+	case path == "/v1/status/leader":
+		w.Write([]byte(`"10.0.0.1:8300"`))
+	case path == "/v1/agent/self":
+		w.Write([]byte(`{"Config":{"NodeName":"node1"}}`))
+	case strings.HasPrefix(path, "/v1/kv/"):
+		f.serveKV(w, req, strings.TrimPrefix(path, "/v1/kv/"), body)
+	case path == "/v1/session/create":
+		var entry struct{ Name, TTL, Behavior string }
+		json.Unmarshal(body, &entry)
+		f.created++
+		id := "session" + strconv.Itoa(f.created)
+		f.sessions[id] = &consulapi.SessionEntry{ID: id, Name: entry.Name, Node: "node1", TTL: entry.TTL, Behavior: entry.Behavior}
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(path, "/v1/session/renew/"), strings.HasPrefix(path, "/v1/session/info/"):
+		entry := f.sessions[path[strings.LastIndex(path, "/")+1:]]
+		if entry == nil {
+			if strings.Contains(path, "renew") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`[]`))
+			return
+		}
+		json.NewEncoder(w).Encode([]*consulapi.SessionEntry{entry})
+	case strings.HasPrefix(path, "/v1/session/destroy/"):
+		f.expire(strings.TrimPrefix(path, "/v1/session/destroy/"))
+		w.Write([]byte(`true`))
+	case path == "/v1/session/node/node1":
+		entries := make([]*consulapi.SessionEntry, 0, len(f.sessions))
+		for _, entry := range f.sessions {
+			entries = append(entries, entry)
+		}
+		json.NewEncoder(w).Encode(entries)
+	case path == "/v1/txn":
+		var ops consulapi.TxnOps
+		if err := json.Unmarshal(body, &ops); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.txn(w, ops)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeConsul) serveKV(w http.ResponseWriter, req *http.Request, key string, body []byte) {
+	_, recurse := req.URL.Query()["recurse"]
+	switch req.Method {
+	case "GET":
+		pairs := make([]*consulapi.KVPair, 0)
+		for k, pair := range f.kv {
+			if k == key || recurse && strings.HasPrefix(k, key) {
+				pairs = append(pairs, pair)
+			}
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+	case "PUT":
+		session := req.URL.Query().Get("acquire")
+		if err := f.lock(key, session); err != "" {
+			if f.sessions[session] == nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			w.Write([]byte(`false`))
+			return
+		}
+		f.kv[key] = &consulapi.KVPair{Key: key, Value: body, Session: session}
+		w.Write([]byte(`true`))
+	case "DELETE":
+		f.delete(key, recurse)
+		w.Write([]byte(`true`))
+	}
+}
+
+// lock returns why key can't be written with session, "" if it can.
+func (f *fakeConsul) lock(key, session string) string {
+	if session == "" {
+		return ""
+	}
+	if f.sessions[session] == nil {
+		return "invalid session " + session
+	}
+	if pair := f.kv[key]; pair != nil && pair.Session != "" && pair.Session != session {
+		return key + " is locked by " + pair.Session
+	}
+	return ""
+}
+
+func (f *fakeConsul) delete(key string, recurse bool) {
+	for k := range f.kv {
+		if k == key || recurse && strings.HasPrefix(k, key) {
+			delete(f.kv, k)
+		}
+	}
+}
+
+// txn runs ops all or nothing, rejecting locks that can't be taken.
+func (f *fakeConsul) txn(w http.ResponseWriter, ops consulapi.TxnOps) {
+	f.txns++
+	var res consulapi.TxnResponse
+	for i, op := range ops {
+		if op.KV.Verb == consulapi.KVLock {
+			if err := f.lock(op.KV.Key, op.KV.Session); err != "" {
+				res.Errors = append(res.Errors, &consulapi.TxnError{OpIndex: i, What: err})
+			}
+		}
+	}
+	if len(res.Errors) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(&res)
+		return
+	}
+	for _, op := range ops {
+		switch op.KV.Verb {
+		case consulapi.KVSet, consulapi.KVLock:
+			f.kv[op.KV.Key] = &consulapi.KVPair{Key: op.KV.Key, Value: op.KV.Value, Session: op.KV.Session}
+		case consulapi.KVDelete:
+			f.delete(op.KV.Key, false)
+		case consulapi.KVDeleteTree:
+			f.delete(op.KV.Key, true)
+		}
+	}
+	json.NewEncoder(w).Encode(&res)
+}
+
+// expire drops a session and the keys it holds. Must be called with the
+// lock held.
+func (f *fakeConsul) expire(id string) {
+	delete(f.sessions, id)
+	for k, pair := range f.kv {
+		if pair.Session == id {
+			delete(f.kv, k)
+		}
+	}
+}
+
+// keys returns the stored keys, sorted.
+func (f *fakeConsul) keys() []string {
+	f.Lock()
+	defer f.Unlock()
+	keys := make([]string, 0, len(f.kv))
+	for k := range f.kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeConsul) value(key string) string {
+	f.Lock()
+	defer f.Unlock()
+	if pair := f.kv[key]; pair != nil {
+		return string(pair.Value)
+	}
+	return ""
+}
+
+func (f *fakeConsul) session(key string) *consulapi.SessionEntry {
+	f.Lock()
+	defer f.Unlock()
+	if pair := f.kv[key]; pair != nil {
+		return f.sessions[pair.Session]
+	}
+	return nil
+}
+
+// newAdapter returns an adapter for uri, whose host is replaced with a fake
+// Consul.
+func newAdapter(t *testing.T, uri string) (*ConsulKVAdapter, *fakeConsul) {
+	f := &fakeConsul{
+		kv:       make(map[string]*consulapi.KVPair),
+		sessions: make(map[string]*consulapi.SessionEntry),
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Host = server.Listener.Addr().String()
+	adapter, err := new(Factory).New(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return adapter.(*ConsulKVAdapter), f
+}
+
+var web = &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080,
+	Tags: []string{"a", "b"}, Attrs: map[string]string{"region": "eu"}}
+
+func TestRegisterDeregister(t *testing.T) {
+	r, f := newAdapter(t, "consulkv:///services")
+	ctx := context.Background()
+	assert.NoError(t, r.Ping(ctx))
+
+	assert.NoError(t, r.Register(ctx, web))
+	assert.Equal(t, "10.0.0.2:8080", f.value("services/web/host:web:80"))
+	services, err := r.Services(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []*bridge.Service{{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080}}, services)
+
+	assert.NoError(t, r.Deregister(ctx, web))
+	assert.Empty(t, f.keys())
+	services, err = r.Services(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, services)
+}
+
+func TestFormats(t *testing.T) {
+	ctx := context.Background()
+
+	r, f := newAdapter(t, "consulkv:///services?format=json")
+	assert.NoError(t, r.Register(ctx, web))
+	var record map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(f.value("services/web/host:web:80")), &record))
+	assert.Equal(t, "10.0.0.2", record["ip"])
+	services, err := r.Services(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+	assert.Equal(t, web.Tags, services[0].Tags)
+	assert.Equal(t, web.Attrs, services[0].Attrs)
+
+	r, f = newAdapter(t, "consulkv:///services?format=env")
+	assert.NoError(t, r.Register(ctx, web))
+	assert.Equal(t, "8080", f.value("services/web/host:web:80/port"))
+	assert.Equal(t, "eu", f.value("services/web/host:web:80/attrs/region"))
+	services, err = r.Services(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+	assert.Equal(t, web.Attrs, services[0].Attrs)
+	assert.NoError(t, r.Deregister(ctx, web))
+	assert.Empty(t, f.keys())
+}
+
+func TestLayout(t *testing.T) {
+	ctx := context.Background()
+	r, f := newAdapter(t, "consulkv:///services?format=json&key="+url.QueryEscape("{{.Name}}/{{.Tag}}/{{.ID}}"))
+
+	assert.NoError(t, r.Register(ctx, web))
+
+	assert.Equal(t, []string{"services/web/a/host:web:80", "services/web/b/host:web:80"}, f.keys())
+	services, err := r.Services(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+	assert.ElementsMatch(t, []string{"a", "b"}, services[0].Tags)
+
+	assert.NoError(t, r.Deregister(ctx, web))
+	assert.Empty(t, f.keys())
+}
+
+func TestServicesSkipsUndecodable(t *testing.T) {
+	ctx := context.Background()
+	r, f := newAdapter(t, "consulkv:///services")
+	assert.NoError(t, r.Register(ctx, web))
+	f.kv["services/db/host:db:5432"] = &consulapi.KVPair{Key: "services/db/host:db:5432", Value: []byte("no port")}
+
+	services, err := r.Services(ctx)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []*bridge.Service{{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080}}, services)
+}
+
+func TestSessionPerTTL(t *testing.T) {
+	ctx := context.Background()
+	r, f := newAdapter(t, "consulkv:///services")
+	short := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080, TTL: 30}
+	other := &bridge.Service{ID: "host:web:81", Name: "web", IP: "10.0.0.2", Port: 8081, TTL: 30}
+	long := &bridge.Service{ID: "host:db:5432", Name: "db", IP: "10.0.0.3", Port: 5432, TTL: 60}
+
+	for _, service := range []*bridge.Service{short, other, long} {
+		assert.NoError(t, r.Register(ctx, service))
+	}
+
+	assert.Equal(t, 2, f.created)
+	session := f.session("services/web/host:web:80")
+	assert.Equal(t, "30s", session.TTL)
+	assert.Equal(t, consulapi.SessionBehaviorDelete, session.Behavior)
+	assert.Equal(t, "registrator:"+bridge.Hostname+":/services:30", session.Name)
+	assert.Equal(t, session, f.session("services/web/host:web:81"))
+	assert.Equal(t, "60s", f.session("services/db/host:db:5432").TTL)
+}
+
+func TestMinSessionTTL(t *testing.T) {
+	ctx := context.Background()
+	r, f := newAdapter(t, "consulkv:///services")
+
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080, TTL: 5}))
+
+	session := f.session("services/web/host:web:80")
+	assert.Equal(t, "10s", session.TTL)
+	assert.Equal(t, "registrator:"+bridge.Hostname+":/services:5", session.Name)
+}
+
+func TestStaleSessionDestroyed(t *testing.T) {
+	ctx := context.Background()
+	r, f := newAdapter(t, "consulkv:///services")
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080, TTL: 30}
+	// left behind by a previous run, still holding the key
+	name := "registrator:" + bridge.Hostname + ":/services:30"
+	f.sessions["stale"] = &consulapi.SessionEntry{ID: "stale", Name: name, Node: "node1", TTL: "30s"}
+	f.sessions["other"] = &consulapi.SessionEntry{ID: "other", Name: "someone else", Node: "node1", TTL: "30s"}
+	f.kv["services/web/host:web:80"] = &consulapi.KVPair{Key: "services/web/host:web:80", Session: "stale"}
+
+	assert.NoError(t, r.Register(ctx, service))
+
+	assert.NotContains(t, f.sessions, "stale")
+	assert.Contains(t, f.sessions, "other")
+	assert.Equal(t, name, f.session("services/web/host:web:80").Name)
+	assert.Equal(t, "10.0.0.2:8080", f.value("services/web/host:web:80"))
+}
+
+func TestAcquireHeldByOtherSession(t *testing.T) {
+	ctx := context.Background()
+	r, f := newAdapter(t, "consulkv:///services")
+	f.sessions["other"] = &consulapi.SessionEntry{ID: "other", Name: "someone else", Node: "node1", TTL: "30s"}
+	f.kv["services/web/host:web:80"] = &consulapi.KVPair{Key: "services/web/host:web:80", Value: []byte("10.0.0.9:80"), Session: "other"}
+
+	err := r.Register(ctx, &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080, TTL: 30})
+
+	assert.EqualError(t, err, "consulkv: services/web/host:web:80 is held by another session")
+	assert.Equal(t, "10.0.0.9:80", f.value("services/web/host:web:80"))
+}
+
+func TestRefresh(t *testing.T) {
+	ctx := context.Background()
+	r, f := newAdapter(t, "consulkv:///services")
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080, TTL: 30}
+	assert.NoError(t, r.Register(ctx, service))
+	first := f.session("services/web/host:web:80").ID
+
+	// renewed, keys untouched
+	r.sessions[30].renewed = time.Time{}
+	assert.NoError(t, r.Refresh(ctx, service))
+	assert.Equal(t, first, f.session("services/web/host:web:80").ID)
+	assert.Equal(t, 1, f.created)
+
+	// acquired again under a new session once it expired
+	f.Lock()
+	f.expire(first)
+	f.Unlock()
+	r.sessions[30].renewed = time.Time{}
+	assert.NoError(t, r.Refresh(ctx, service))
+	assert.Equal(t, 2, f.created)
+	assert.NotEqual(t, first, f.session("services/web/host:web:80").ID)
+	assert.Equal(t, "10.0.0.2:8080", f.value("services/web/host:web:80"))
+	assert.NoError(t, r.Health(ctx))
+}
@@ -0,0 +1,191 @@
+package coredns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/42wim/registrator-work/etcd3"
+	"github.com/42wim/registrator-work/skydns2"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// DefaultPath is the root the CoreDNS etcd plugin reads records from unless
+// configured otherwise.
+const DefaultPath = "/skydns"
+
+func init() {
+	bridge.Register(new(Factory), "coredns")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
+	if len(uri.Path) < 2 {
+		return nil, errors.New("coredns: dns domain required e.g.: coredns://<host>/<domain>")
+	}
+	root := DefaultPath
+	if path := uri.Query().Get("path"); path != "" {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("coredns: path %q must start with /", path)
+		}
+		root = strings.TrimSuffix(path, "/")
+	}
+	endpoints := []string{"127.0.0.1:2379"}
+	if uri.Host != "" {
+		endpoints = strings.Split(uri.Host, ",")
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: etcd3.DefaultTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("coredns: %v", err)
+	}
+	return &CorednsAdapter{
+		client: client,
+		path:   skydns2.DomainPath(root, uri.Path[1:]),
+		leases: etcd3.NewLeases(client, "coredns"),
+	}, nil
+}
+
+// CorednsAdapter writes services to etcd v3 in the SkyDNS message format
+// read by the CoreDNS etcd plugin.
+type CorednsAdapter struct {
+	sync.Mutex
+	client *clientv3.Client
+	path   string
+
+	// leases hold the records written with a TTL, one per TTL.
+	leases *etcd3.Leases
+}
+
+// Ping asks every endpoint for its status until one answers.
+func (r *CorednsAdapter) Ping(ctx context.Context) error {
+	var err error
+	for _, endpoint := range r.client.Endpoints() {
+		var status *clientv3.StatusResponse
+		status, err = r.client.Status(ctx, endpoint)
+		if err == nil {
+			log.Println("coredns: connected to", endpoint, "version", status.Version)
+			return nil
+		}
+	}
+	return err
+}
+
+func (r *CorednsAdapter) Register(ctx context.Context, service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	err := r.put(ctx, service)
+	if err != nil {
+		log.Println("coredns: failed to register service:", err)
+	}
+	return err
+}
+
+func (r *CorednsAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	r.leases.Release(service.ID)
+	_, err := r.client.Delete(ctx, r.servicePath(service))
+	if err != nil {
+		log.Println("coredns: failed to deregister service:", err)
+	}
+	return etcd3.Classify(err)
+}
+
+// Refresh keeps the lease of the service's record alive. If the lease
+// expired in the meantime, the record is written again under a new one.
+func (r *CorednsAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	if service.TTL == 0 {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	alive, err := r.leases.KeepAlive(ctx, service.ID, service.TTL)
+	if err != nil {
+		log.Println("coredns: failed to keep lease alive:", err)
+		return err
+	}
+	if alive {
+		return nil
+	}
+	err = r.put(ctx, service)
+	if err != nil {
+		log.Println("coredns: failed to register service:", err)
+	}
+	return err
+}
+
+func (r *CorednsAdapter) Services(ctx context.Context) ([]*bridge.Service, error) {
+	res, err := r.client.Get(ctx, r.path+"/", clientv3.WithPrefix())
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	values := make(map[string]string, len(res.Kvs))
+	for _, pair := range res.Kvs {
+		values[string(pair.Key)] = string(pair.Value)
+	}
+	return parseServices(r.path, values), nil
+}
+
+// put writes the record of service, under the lease of its TTL if it has
+// one. Must be called with the lock held.
+func (r *CorednsAdapter) put(ctx context.Context, service *bridge.Service) error {
+	value, err := skydns2.ServiceRecord(service)
+	if err != nil {
+		return bridge.Permanent(err)
+	}
+	lease, err := r.leases.Grant(ctx, service.TTL)
+	if err != nil {
+		return err
+	}
+
+	var opts []clientv3.OpOption
+	if lease != 0 {
+		opts = append(opts, clientv3.WithLease(lease))
+	}
+	if _, err := r.client.Put(ctx, r.servicePath(service), value, opts...); err != nil {
+		return etcd3.Classify(err)
+	}
+	r.leases.Hold(service.ID, lease)
+	return nil
+}
+
+// servicePath returns the key of service, which ends in the ID as is so that
+// parseServices reads it back.
+func (r *CorednsAdapter) servicePath(service *bridge.Service) string {
+	return r.path + "/" + service.Name + "/" + service.ID
+}
+
+// parseServices reads the services stored below path at <name>/<id>.
+// Records at other depths, e.g. of subdomains, are skipped.
+func parseServices(path string, values map[string]string) []*bridge.Service {
+	services := make([]*bridge.Service, 0)
+	for key, value := range values {
+		components := strings.Split(strings.TrimPrefix(key, path+"/"), "/")
+		if len(components) != 2 {
+			continue
+		}
+		var rec skydns2.Record
+		if err := json.Unmarshal([]byte(value), &rec); err != nil {
+			log.Println("coredns: skipping", key+":", err)
+			continue
+		}
+		services = append(services, &bridge.Service{
+			ID:   components[1],
+			Name: components[0],
+			IP:   rec.Host,
+			Port: rec.Port,
+		})
+	}
+	return services
+}
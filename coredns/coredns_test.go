@@ -0,0 +1,121 @@
+package coredns
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/42wim/registrator-work/internal/etcdtest"
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func newAdapter(t *testing.T, uri string) *CorednsAdapter {
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := new(Factory).New(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter := registry.(*CorednsAdapter)
+	t.Cleanup(func() { adapter.client.Close() })
+	return adapter
+}
+
+func TestFactoryErrors(t *testing.T) {
+	_, err := new(Factory).New(&url.URL{Scheme: "coredns"})
+	assert.EqualError(t, err, "coredns: dns domain required e.g.: coredns://<host>/<domain>")
+
+	_, err = new(Factory).New(&url.URL{Scheme: "coredns", Path: "/cluster.local", RawQuery: "path=skydns"})
+	assert.EqualError(t, err, `coredns: path "skydns" must start with /`)
+}
+
+func TestServicePath(t *testing.T) {
+	r := &CorednsAdapter{path: "/skydns/local/cluster"}
+
+	path := r.servicePath(&bridge.Service{ID: "host:web:80:udp", Name: "web"})
+
+	assert.Equal(t, "/skydns/local/cluster/web/host:web:80:udp", path)
+}
+
+func TestParseServices(t *testing.T) {
+	services := parseServices("/skydns/local/cluster", map[string]string{
+		"/skydns/local/cluster/web/host:web:80": `{"host":"10.0.0.2","port":80,"priority":10}`,
+		"/skydns/local/cluster/db/db-1":         `{"host":"10.0.0.3","port":5432}`,
+		"/skydns/local/cluster/db/db-2":         `garbage`,
+		"/skydns/local/cluster/web/a/web-1":     `{"host":"10.0.0.2","port":80}`,
+		"/skydns/local/cluster/other/x/y/z/w":   `{"host":"10.0.0.4"}`,
+	})
+
+	assert.ElementsMatch(t, []*bridge.Service{
+		{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 80},
+		{ID: "db-1", Name: "db", IP: "10.0.0.3", Port: 5432},
+	}, services)
+}
+
+func TestRegisterDeregister(t *testing.T) {
+	ctx := context.Background()
+	adapter := newAdapter(t, "coredns://"+etcdtest.Start(t)+"/cluster.local?path=/dns")
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080,
+		Attrs: map[string]string{"skydns_priority": "10"}}
+	assert.NoError(t, adapter.Ping(ctx))
+
+	assert.NoError(t, adapter.Register(ctx, service))
+	res, err := adapter.client.Get(ctx, "/dns/local/cluster/web/host:web:80")
+	assert.NoError(t, err)
+	assert.Len(t, res.Kvs, 1)
+	assert.JSONEq(t, `{"host":"10.0.0.2","port":8080,"priority":10}`, string(res.Kvs[0].Value))
+	services, err := adapter.Services(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []*bridge.Service{{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080}}, services)
+
+	assert.NoError(t, adapter.Deregister(ctx, service))
+	services, err = adapter.Services(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, services)
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	adapter := newAdapter(t, "coredns://"+etcdtest.Start(t)+"/cluster.local")
+	web := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080, TTL: 30}
+	db := &bridge.Service{ID: "host:db:5432", Name: "db", IP: "10.0.0.3", Port: 5432, TTL: 60}
+
+	assert.NoError(t, adapter.Register(ctx, web))
+	assert.NoError(t, adapter.Register(ctx, db))
+
+	// one lease per TTL
+	lease := leaseOf(t, adapter, "/skydns/local/cluster/web/host:web:80")
+	for key, ttl := range map[string]int64{
+		"/skydns/local/cluster/web/host:web:80": 30,
+		"/skydns/local/cluster/db/host:db:5432": 60,
+	} {
+		res, err := adapter.client.TimeToLive(ctx, leaseOf(t, adapter, key))
+		assert.NoError(t, err)
+		assert.Equal(t, ttl, res.GrantedTTL, key)
+	}
+
+	// refreshing keeps the record under its lease
+	assert.NoError(t, adapter.Refresh(ctx, web))
+	assert.Equal(t, lease, leaseOf(t, adapter, "/skydns/local/cluster/web/host:web:80"))
+
+	// the record comes back under a new lease once the old one is gone
+	_, err := adapter.client.Revoke(ctx, lease)
+	assert.NoError(t, err)
+	time.Sleep(1100 * time.Millisecond)
+	assert.NoError(t, adapter.Refresh(ctx, web))
+	assert.NotEqual(t, lease, leaseOf(t, adapter, "/skydns/local/cluster/web/host:web:80"))
+}
+
+// leaseOf returns the lease key was put with.
+func leaseOf(t *testing.T, adapter *CorednsAdapter, key string) clientv3.LeaseID {
+	res, err := adapter.client.Get(context.Background(), key)
+	if err != nil || len(res.Kvs) == 0 {
+		t.Fatal("no key", key, err)
+	}
+	return clientv3.LeaseID(res.Kvs[0].Lease)
+}
@@ -0,0 +1,340 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	miekg "github.com/miekg/dns"
+)
+
+// DefaultAddr is the address the server listens on unless one is given.
+const DefaultAddr = ":53"
+
+func init() {
+	bridge.Register(new(Factory), "dns")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
+	if len(uri.Path) < 2 {
+		return nil, errors.New("dns: dns domain required e.g.: dns://<address>:<port>/<domain>")
+	}
+	domain := strings.Trim(uri.Path[1:], "/")
+	if _, ok := miekg.IsDomainName(domain); !ok {
+		return nil, fmt.Errorf("dns: invalid domain %q", domain)
+	}
+	addr := DefaultAddr
+	if uri.Host != "" {
+		addr = uri.Host
+	}
+	return &DNSAdapter{
+		addr:     addr,
+		domain:   miekg.Fqdn(strings.ToLower(domain)),
+		services: make(map[string]*entry),
+		now:      time.Now,
+	}, nil
+}
+
+// DNSAdapter keeps services in memory and answers queries for them from an
+// embedded authoritative DNS server:
+//
+//	<name>.<domain>             A/AAAA of all instances
+//	<tag>.<name>.<domain>       A/AAAA of the instances with the tag
+//	<id>.<name>.<domain>        A/AAAA of one instance, the SRV target
+//	_<name>._<proto>.<domain>   SRV of the instances using the protocol
+//	<tag>._<name>._<proto>.<domain>
+type DNSAdapter struct {
+	sync.RWMutex
+	addr     string
+	domain   string
+	services map[string]*entry // by service ID
+	servers  []*miekg.Server
+	now      func() time.Time
+}
+
+type entry struct {
+	service *bridge.Service
+	expires time.Time // zero if the service doesn't expire
+}
+
+// Ping starts the server on its first call. It runs until the bridge shuts
+// down.
+func (r *DNSAdapter) Ping(ctx context.Context) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.servers != nil {
+		return nil
+	}
+
+	conn, err := net.ListenPacket("udp", r.addr)
+	if err != nil {
+		return bridge.Permanent(fmt.Errorf("dns: %v", err))
+	}
+	// with port 0, listen on TCP on the port picked for UDP
+	r.addr = conn.LocalAddr().String()
+	listener, err := net.Listen("tcp", r.addr)
+	if err != nil {
+		conn.Close()
+		return bridge.Permanent(fmt.Errorf("dns: %v", err))
+	}
+	r.servers = []*miekg.Server{
+		{PacketConn: conn, Handler: r},
+		{Listener: listener, Handler: r},
+	}
+	for _, server := range r.servers {
+		go func(server *miekg.Server) {
+			if err := server.ActivateAndServe(); err != nil {
+				log.Println("dns: server stopped:", err)
+			}
+		}(server)
+	}
+	// stop serving once the bridge shuts down
+	if done := bridge.Lifetime(ctx).Done(); done != nil {
+		go func() {
+			<-done
+			r.shutdown()
+		}()
+	}
+	log.Println("dns: serving", r.domain, "on", r.addr)
+	return nil
+}
+
+// shutdown stops the server.
+func (r *DNSAdapter) shutdown() {
+	r.Lock()
+	defer r.Unlock()
+	for _, server := range r.servers {
+		server.Shutdown()
+	}
+	r.servers = nil
+}
+
+// Addr returns the address the server listens on.
+func (r *DNSAdapter) Addr() string {
+	r.RLock()
+	defer r.RUnlock()
+	return r.addr
+}
+
+func (r *DNSAdapter) Register(ctx context.Context, service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	e := &entry{service: service}
+	if service.TTL > 0 {
+		e.expires = r.now().Add(time.Duration(service.TTL) * time.Second)
+	}
+	r.services[service.ID] = e
+	return nil
+}
+
+func (r *DNSAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.services, service.ID)
+	return nil
+}
+
+func (r *DNSAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	return r.Register(ctx, service)
+}
+
+func (r *DNSAdapter) Services(ctx context.Context) ([]*bridge.Service, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.expire()
+	services := make([]*bridge.Service, 0, len(r.services))
+	for _, e := range r.services {
+		services = append(services, e.service)
+	}
+	return services, nil
+}
+
+// expire drops the services whose TTL ran out. Must be called with the
+// lock held.
+func (r *DNSAdapter) expire() {
+	now := r.now()
+	for id, e := range r.services {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(r.services, id)
+		}
+	}
+}
+
+// ServeDNS answers a query about the domain.
+func (r *DNSAdapter) ServeDNS(w miekg.ResponseWriter, req *miekg.Msg) {
+	m := new(miekg.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	if len(req.Question) != 1 {
+		m.SetRcode(req, miekg.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	if !miekg.IsSubDomain(r.domain, name) {
+		m.Authoritative = false
+		m.SetRcode(req, miekg.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	r.Lock()
+	r.expire()
+	services, srv := r.lookup(name)
+	r.Unlock()
+
+	switch {
+	case name == r.domain:
+		if q.Qtype == miekg.TypeSOA {
+			m.Answer = append(m.Answer, r.soa())
+		} else {
+			m.Ns = append(m.Ns, r.soa())
+		}
+	case services == nil:
+		m.SetRcode(req, miekg.RcodeNameError)
+		m.Ns = append(m.Ns, r.soa())
+	default:
+		m.Answer = r.answer(q, services, srv)
+		if srv && q.Qtype == miekg.TypeSRV {
+			for _, service := range services {
+				m.Extra = append(m.Extra, r.address(r.target(service), service)...)
+			}
+		}
+		if len(m.Answer) == 0 {
+			m.Ns = append(m.Ns, r.soa())
+		}
+	}
+	w.WriteMsg(m)
+}
+
+// lookup returns the services a name below the domain refers to, or nil if
+// it refers to none, and whether it is an SRV name.
+func (r *DNSAdapter) lookup(name string) ([]*bridge.Service, bool) {
+	labels := miekg.SplitDomainName(strings.TrimSuffix(name, r.domain))
+	var tag, proto string
+	var srv bool
+	switch {
+	case len(labels) == 1:
+	case len(labels) == 2 && !strings.HasPrefix(labels[0], "_"):
+		tag = labels[0]
+	case len(labels) == 2 && strings.HasPrefix(labels[1], "_"):
+		srv, proto = true, labels[1][1:]
+	case len(labels) == 3 && strings.HasPrefix(labels[1], "_") && strings.HasPrefix(labels[2], "_"):
+		tag, srv, proto = labels[0], true, labels[2][1:]
+	default:
+		return nil, false
+	}
+	serviceName := labels[len(labels)-1]
+	if srv {
+		serviceName = strings.TrimPrefix(labels[len(labels)-2], "_")
+	}
+
+	var services []*bridge.Service
+	for _, e := range r.services {
+		service := e.service
+		if !strings.EqualFold(service.Name, serviceName) {
+			continue
+		}
+		if srv && !strings.EqualFold(protocol(service), proto) {
+			continue
+		}
+		if tag != "" && !hasTag(service, tag) && (srv || label(service.ID) != tag) {
+			continue
+		}
+		services = append(services, service)
+	}
+	return services, srv
+}
+
+// answer returns the records of services of the question's type, SRV
+// records at SRV names and addresses at the others.
+func (r *DNSAdapter) answer(q miekg.Question, services []*bridge.Service, srv bool) []miekg.RR {
+	var answer []miekg.RR
+	for _, service := range services {
+		switch {
+		case srv && (q.Qtype == miekg.TypeSRV || q.Qtype == miekg.TypeANY):
+			answer = append(answer, &miekg.SRV{
+				Hdr:    header(q.Name, miekg.TypeSRV, service),
+				Port:   uint16(service.Port),
+				Target: r.target(service),
+			})
+		case !srv:
+			for _, rr := range r.address(q.Name, service) {
+				if q.Qtype == miekg.TypeANY || rr.Header().Rrtype == q.Qtype {
+					answer = append(answer, rr)
+				}
+			}
+		}
+	}
+	return answer
+}
+
+// address returns the A or AAAA record of service at name.
+func (r *DNSAdapter) address(name string, service *bridge.Service) []miekg.RR {
+	ip := net.ParseIP(strings.Trim(service.IP, "[]"))
+	if ip == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return []miekg.RR{&miekg.A{Hdr: header(name, miekg.TypeA, service), A: v4}}
+	}
+	return []miekg.RR{&miekg.AAAA{Hdr: header(name, miekg.TypeAAAA, service), AAAA: ip}}
+}
+
+// target returns the name of the instance service, which SRV records
+// point to.
+func (r *DNSAdapter) target(service *bridge.Service) string {
+	return label(service.ID) + "." + strings.ToLower(service.Name) + "." + r.domain
+}
+
+func (r *DNSAdapter) soa() miekg.RR {
+	return &miekg.SOA{
+		Hdr:     miekg.RR_Header{Name: r.domain, Rrtype: miekg.TypeSOA, Class: miekg.ClassINET},
+		Ns:      "ns." + r.domain,
+		Mbox:    "hostmaster." + r.domain,
+		Serial:  uint32(r.now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+	}
+}
+
+// header returns the header of a record of service. Answers can be cached
+// as long as the service's TTL, and not at all if it has none.
+func header(name string, rrtype uint16, service *bridge.Service) miekg.RR_Header {
+	return miekg.RR_Header{Name: name, Rrtype: rrtype, Class: miekg.ClassINET, Ttl: uint32(service.TTL)}
+}
+
+// protocol returns the protocol of service, tcp unless it is published
+// over udp.
+func protocol(service *bridge.Service) string {
+	if service.Origin.PortType != "" {
+		return service.Origin.PortType
+	}
+	return "tcp"
+}
+
+func hasTag(service *bridge.Service, tag string) bool {
+	for _, t := range service.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// label turns a service ID into a DNS label.
+func label(id string) string {
+	return strings.ToLower(strings.NewReplacer(":", "-", ".", "-").Replace(id))
+}
@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	miekg "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startServer runs an adapter for cluster.local on a free loopback port.
+func startServer(t *testing.T) *DNSAdapter {
+	adapter, err := new(Factory).New(&url.URL{Scheme: "dns", Host: "127.0.0.1:0", Path: "/cluster.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := adapter.(*DNSAdapter)
+	if err := r.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.shutdown)
+	return r
+}
+
+func query(t *testing.T, r *DNSAdapter, net, name string, qtype uint16) *miekg.Msg {
+	m := new(miekg.Msg)
+	m.SetQuestion(name, qtype)
+	res, _, err := (&miekg.Client{Net: net, Timeout: time.Second}).Exchange(m, r.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func register(t *testing.T, r *DNSAdapter, services ...*bridge.Service) {
+	for _, service := range services {
+		assert.NoError(t, r.Register(context.Background(), service))
+	}
+}
+
+func TestFactoryErrors(t *testing.T) {
+	_, err := new(Factory).New(&url.URL{Scheme: "dns"})
+	assert.EqualError(t, err, "dns: dns domain required e.g.: dns://<address>:<port>/<domain>")
+
+	_, err = new(Factory).New(&url.URL{Scheme: "dns", Path: "/bad..domain"})
+	assert.EqualError(t, err, `dns: invalid domain "bad..domain"`)
+}
+
+func TestAddressQueries(t *testing.T) {
+	r := startServer(t)
+	register(t, r,
+		&bridge.Service{ID: "host:web1:80", Name: "web", IP: "10.0.0.2", Port: 80, Tags: []string{"primary"}},
+		&bridge.Service{ID: "host:web2:80", Name: "web", IP: "10.0.0.3", Port: 80},
+		&bridge.Service{ID: "host:web1:80:ipv6", Name: "web", IP: "2001:db8::2", Port: 80},
+	)
+
+	res := query(t, r, "udp", "web.cluster.local.", miekg.TypeA)
+	assert.True(t, res.Authoritative)
+	assert.ElementsMatch(t, []string{"10.0.0.2", "10.0.0.3"}, addresses(res))
+
+	res = query(t, r, "tcp", "WEB.cluster.local.", miekg.TypeAAAA)
+	assert.Equal(t, []string{"2001:db8::2"}, addresses(res))
+
+	res = query(t, r, "udp", "primary.web.cluster.local.", miekg.TypeA)
+	assert.Equal(t, []string{"10.0.0.2"}, addresses(res))
+
+	res = query(t, r, "udp", "host-web2-80.web.cluster.local.", miekg.TypeA)
+	assert.Equal(t, []string{"10.0.0.3"}, addresses(res))
+}
+
+func TestSRVQueries(t *testing.T) {
+	r := startServer(t)
+	register(t, r,
+		&bridge.Service{ID: "host:web1:80", Name: "web", IP: "10.0.0.2", Port: 8080, Tags: []string{"primary"}},
+		&bridge.Service{ID: "host:web2:80", Name: "web", IP: "10.0.0.3", Port: 8081},
+		&bridge.Service{ID: "host:dns:53:udp", Name: "web", IP: "10.0.0.4", Port: 53,
+			Origin: bridge.ServicePort{PortType: "udp"}},
+	)
+
+	res := query(t, r, "udp", "_web._tcp.cluster.local.", miekg.TypeSRV)
+	assert.Len(t, res.Answer, 2)
+	assert.Len(t, res.Extra, 2)
+
+	res = query(t, r, "udp", "primary._web._tcp.cluster.local.", miekg.TypeSRV)
+	if assert.Len(t, res.Answer, 1) {
+		srv := res.Answer[0].(*miekg.SRV)
+		assert.Equal(t, uint16(8080), srv.Port)
+		assert.Equal(t, "host-web1-80.web.cluster.local.", srv.Target)
+	}
+	assert.Equal(t, []string{"10.0.0.2"}, addresses(&miekg.Msg{Answer: res.Extra}))
+
+	res = query(t, r, "udp", "_web._udp.cluster.local.", miekg.TypeSRV)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, uint16(53), res.Answer[0].(*miekg.SRV).Port)
+	}
+}
+
+func TestMissingNames(t *testing.T) {
+	r := startServer(t)
+	register(t, r, &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80})
+
+	res := query(t, r, "udp", "db.cluster.local.", miekg.TypeA)
+	assert.Equal(t, miekg.RcodeNameError, res.Rcode)
+	assert.Len(t, res.Ns, 1)
+
+	res = query(t, r, "udp", "web.cluster.local.", miekg.TypeAAAA)
+	assert.Equal(t, miekg.RcodeSuccess, res.Rcode)
+	assert.Empty(t, res.Answer)
+	assert.Len(t, res.Ns, 1)
+
+	res = query(t, r, "udp", "example.com.", miekg.TypeA)
+	assert.Equal(t, miekg.RcodeRefused, res.Rcode)
+
+	res = query(t, r, "udp", "cluster.local.", miekg.TypeSOA)
+	assert.Len(t, res.Answer, 1)
+}
+
+func TestExpiry(t *testing.T) {
+	r := startServer(t)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	register(t, r,
+		&bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80, TTL: 30},
+		&bridge.Service{ID: "web2", Name: "web", IP: "10.0.0.3", Port: 80},
+	)
+
+	res := query(t, r, "udp", "web.cluster.local.", miekg.TypeA)
+	assert.Len(t, res.Answer, 2)
+
+	r.Lock()
+	now = now.Add(31 * time.Second)
+	r.Unlock()
+	res = query(t, r, "udp", "web.cluster.local.", miekg.TypeA)
+	assert.Equal(t, []string{"10.0.0.3"}, addresses(res))
+
+	services, err := r.Services(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+}
+
+func TestDeregister(t *testing.T) {
+	r := startServer(t)
+	service := &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80}
+	register(t, r, service)
+
+	assert.NoError(t, r.Deregister(context.Background(), service))
+
+	res := query(t, r, "udp", "web.cluster.local.", miekg.TypeA)
+	assert.Equal(t, miekg.RcodeNameError, res.Rcode)
+}
+
+func addresses(m *miekg.Msg) []string {
+	var ips []string
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *miekg.A:
+			ips = append(ips, rr.A.String())
+		case *miekg.AAAA:
+			ips = append(ips, rr.AAAA.String())
+		}
+	}
+	return ips
+}
+
+func TestShutdown(t *testing.T) {
+	adapter, err := new(Factory).New(&url.URL{Scheme: "dns", Host: "127.0.0.1:0", Path: "/cluster.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := adapter.(*DNSAdapter)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, r.Ping(ctx))
+	assert.Equal(t, miekg.RcodeNameError, query(t, r, "tcp", "web.cluster.local.", miekg.TypeA).Rcode)
+
+	cancel()
+
+	m := new(miekg.Msg)
+	m.SetQuestion("web.cluster.local.", miekg.TypeA)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, _, err := (&miekg.Client{Net: "tcp", Timeout: 100 * time.Millisecond}).Exchange(m, r.Addr()); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server still answering")
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package etcd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	etcd2 "github.com/coreos/go-etcd/etcd"
+	etcd "gopkg.in/coreos/go-etcd.v0/etcd"
+)
+
+// DefaultTimeout bounds the version requests sent to etcd.
+const DefaultTimeout = 5 * time.Second
+
+// Endpoints returns the etcd URLs of a backend URI. The host may be a
+// comma-separated list, and a scheme ending in +https selects https, e.g.
+// etcd+https://10.0.0.1:2379,10.0.0.2:2379/services.
+func Endpoints(uri *url.URL, defaultHost string) []string {
+	scheme := "http"
+	if strings.HasSuffix(uri.Scheme, "+https") {
+		scheme = "https"
+	}
+	hosts := uri.Host
+	if hosts == "" {
+		hosts = defaultHost
+	}
+	urls := make([]string, 0)
+	for _, host := range strings.Split(hosts, ",") {
+		if host != "" {
+			urls = append(urls, scheme+"://"+host)
+		}
+	}
+	return urls
+}
+
+// Transport returns the HTTP transport to reach etcd with. For https, it
+// trusts the CA of the tlsca option and presents the client certificate of
+// the tlscert and tlskey options, all of them paths to PEM files.
+func Transport(uri *url.URL) (*http.Transport, error) {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: DefaultTimeout,
+	}
+	if !strings.HasSuffix(uri.Scheme, "+https") {
+		return transport, nil
+	}
+
+	config := &tls.Config{}
+	query := uri.Query()
+	if ca := query.Get("tlsca"); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", ca)
+		}
+	}
+	cert, key := query.Get("tlscert"), query.Get("tlskey")
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("tlscert and tlskey must be specified together")
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	transport.TLSClientConfig = config
+	return transport, nil
+}
+
+// Version asks each endpoint in turn for the etcd version, until one answers.
+func Version(endpoints []string, transport *http.Transport, user *url.Userinfo) ([]byte, error) {
+	client := &http.Client{Transport: transport, Timeout: DefaultTimeout}
+	err := errors.New("no etcd endpoint")
+	for _, endpoint := range endpoints {
+		var req *http.Request
+		req, err = http.NewRequest("GET", endpoint+"/version", nil)
+		if err != nil {
+			continue
+		}
+		if user != nil {
+			password, _ := user.Password()
+			req.SetBasicAuth(user.Username(), password)
+		}
+		var res *http.Response
+		res, err = client.Do(req)
+		if err != nil {
+			continue
+		}
+		body, readErr := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if readErr != nil {
+			err = readErr
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s/version: %s", endpoint, res.Status)
+			continue
+		}
+		return body, nil
+	}
+	return nil, err
+}
+
+// Classify marks the errors etcd returns for invalid commands and requests,
+// those with a code below 300, as permanent. Raft and cluster errors, as
+// well as network failures, are left retryable.
+func Classify(err error) error {
+	if e, ok := err.(*etcd2.EtcdError); ok && e.ErrorCode < 300 {
+		return bridge.Permanent(err)
+	}
+	if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode < 300 {
+		return bridge.Permanent(err)
+	}
+	return err
+}
@@ -1,57 +1,119 @@
 package etcd
 
 import (
-	"io/ioutil"
+	"context"
+	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"regexp"
-	"strconv"
+	"sync"
 
-	etcd2 "github.com/coreos/go-etcd/etcd"
 	"github.com/42wim/registrator-work/bridge"
+	"github.com/42wim/registrator-work/kv"
+	etcd2 "github.com/coreos/go-etcd/etcd"
 	etcd "gopkg.in/coreos/go-etcd.v0/etcd"
 )
 
+// keyNotFound is the etcd error code for a missing key.
+const keyNotFound = 100
+
 func init() {
 	bridge.Register(new(Factory), "etcd")
+	bridge.Register(new(Factory), "etcd+https")
 }
 
 type Factory struct{}
 
-func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
-	urls := make([]string, 0)
-	if uri.Host != "" {
-		urls = append(urls, "http://"+uri.Host)
-	} else {
-		urls = append(urls, "http://127.0.0.1:4001")
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
+	transport, err := Transport(uri)
+	if err != nil {
+		return nil, fmt.Errorf("etcd: %v", err)
 	}
-
-	res, err := http.Get(urls[0] + "/version")
+	format, err := kv.ParseFormat(uri)
+	if err != nil {
+		return nil, fmt.Errorf("etcd: %v", err)
+	}
+	layout, err := kv.ParseLayout(uri)
 	if err != nil {
-		log.Fatal("etcd: error retrieving version", err)
+		return nil, fmt.Errorf("etcd: %v", err)
+	}
+	if err := format.Check(layout); err != nil {
+		return nil, fmt.Errorf("etcd: %v", err)
+	}
+	return &EtcdAdapter{
+		uri:       uri,
+		urls:      Endpoints(uri, "127.0.0.1:4001"),
+		transport: transport,
+		path:      uri.Path,
+		format:    format,
+		layout:    layout,
+	}, nil
+}
+
+type EtcdAdapter struct {
+	sync.Mutex
+	client  *etcd.Client
+	client2 *etcd2.Client
+
+	uri       *url.URL
+	urls      []string
+	transport *http.Transport
+
+	path   string
+	format kv.Format
+	layout *kv.Layout
+}
+
+// connect picks the client matching the etcd version, the first time it
+// succeeds in retrieving the version.
+func (r *EtcdAdapter) connect() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.client != nil || r.client2 != nil {
+		return nil
 	}
 
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
+	body, err := Version(r.urls, r.transport, r.uri.User)
+	if err != nil {
+		return fmt.Errorf("etcd: error retrieving version: %v", err)
+	}
 
 	if match, _ := regexp.Match("0\\.4\\.*", body); match == true {
 		log.Println("etcd: using v0 client")
-		return &EtcdAdapter{client: etcd.NewClient(urls), path: uri.Path}
+		if r.uri.User != nil {
+			log.Println("etcd: v0 has no authentication, ignoring credentials")
+		}
+		if r.transport.TLSClientConfig == nil {
+			r.client = etcd.NewClient(r.urls)
+			return nil
+		}
+		query := r.uri.Query()
+		r.client, err = etcd.NewTLSClient(r.urls, query.Get("tlscert"), query.Get("tlskey"), query.Get("tlsca"))
+		return err
 	}
 
-	return &EtcdAdapter{client2: etcd2.NewClient(urls), path: uri.Path}
+	client2 := etcd2.NewClient(r.urls)
+	client2.SetTransport(r.transport)
+	if r.uri.User != nil {
+		password, _ := r.uri.User.Password()
+		client2.SetCredentials(r.uri.User.Username(), password)
+	}
+	r.client2 = client2
+	return nil
 }
 
-type EtcdAdapter struct {
-	client  *etcd.Client
-	client2 *etcd2.Client
+// The go-etcd clients take no context, so every operation runs through
+// bridge.Await.
 
-	path string
+func (r *EtcdAdapter) Ping(ctx context.Context) error {
+	return bridge.Await(ctx, r.ping)
 }
 
-func (r *EtcdAdapter) Ping() error {
+func (r *EtcdAdapter) ping() error {
+	if err := r.connect(); err != nil {
+		return err
+	}
 	r.syncEtcdCluster()
 
 	var err error
@@ -82,48 +144,189 @@ func (r *EtcdAdapter) syncEtcdCluster() {
 	}
 }
 
-func (r *EtcdAdapter) Register(service *bridge.Service) error {
+func (r *EtcdAdapter) Register(ctx context.Context, service *bridge.Service) error {
+	return bridge.Await(ctx, func() error { return r.register(service) })
+}
+
+func (r *EtcdAdapter) register(service *bridge.Service) error {
+	if err := r.connect(); err != nil {
+		return err
+	}
 	r.syncEtcdCluster()
 
-	path := r.path + "/" + service.Name + "/" + service.ID
-	port := strconv.Itoa(service.Port)
-	addr := net.JoinHostPort(service.IP, port)
+	paths, err := r.servicePaths(service)
+	if err != nil {
+		log.Println("etcd: failed to register service:", err)
+		return bridge.Permanent(err)
+	}
+	values, err := r.format.Encode(service)
+	if err != nil {
+		log.Println("etcd: failed to register service:", err)
+		return bridge.Permanent(err)
+	}
 
-	var err error
-	if r.client != nil {
-		_, err = r.client.Set(path, addr, uint64(service.TTL))
-	} else {
-		_, err = r.client2.Set(path, addr, uint64(service.TTL))
+	for _, path := range paths {
+		ttl := uint64(service.TTL)
+		if r.format == kv.FormatEnv {
+			// the directory carries the TTL of all its keys
+			if ttl > 0 {
+				err = r.updateDir(path, ttl)
+			}
+			ttl = 0
+		}
+		for key, value := range values {
+			if err != nil {
+				break
+			}
+			if key != "" {
+				key = path + "/" + key
+			} else {
+				key = path
+			}
+			if r.client != nil {
+				_, err = r.client.Set(key, value, ttl)
+			} else {
+				_, err = r.client2.Set(key, value, ttl)
+			}
+		}
+		if err != nil {
+			break
+		}
 	}
 
 	if err != nil {
 		log.Println("etcd: failed to register service:", err)
 	}
+	return Classify(err)
+}
+
+// updateDir sets the TTL of the directory at path, creating it if needed.
+func (r *EtcdAdapter) updateDir(path string, ttl uint64) error {
+	var err error
+	if r.client != nil {
+		_, err = r.client.UpdateDir(path, ttl)
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == keyNotFound {
+			_, err = r.client.CreateDir(path, ttl)
+		}
+	} else {
+		_, err = r.client2.UpdateDir(path, ttl)
+		if e, ok := err.(*etcd2.EtcdError); ok && e.ErrorCode == keyNotFound {
+			_, err = r.client2.CreateDir(path, ttl)
+		}
+	}
 	return err
 }
 
-func (r *EtcdAdapter) Deregister(service *bridge.Service) error {
+func (r *EtcdAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	return bridge.Await(ctx, func() error { return r.deregister(service) })
+}
+
+func (r *EtcdAdapter) deregister(service *bridge.Service) error {
+	if err := r.connect(); err != nil {
+		return err
+	}
 	r.syncEtcdCluster()
 
-	path := r.path + "/" + service.Name + "/" + service.ID
+	paths, err := r.servicePaths(service)
+	if err != nil {
+		log.Println("etcd: failed to deregister service:", err)
+		return bridge.Permanent(err)
+	}
+	recursive := r.format == kv.FormatEnv
 
-	var err error
-	if r.client != nil {
-		_, err = r.client.Delete(path, false)
-	} else {
-		_, err = r.client2.Delete(path, false)
+	for _, path := range paths {
+		if r.client != nil {
+			_, err = r.client.Delete(path, recursive)
+		} else {
+			_, err = r.client2.Delete(path, recursive)
+		}
+		if err != nil {
+			break
+		}
 	}
 
 	if err != nil {
 		log.Println("etcd: failed to deregister service:", err)
 	}
-	return err
+	return Classify(err)
 }
 
-func (r *EtcdAdapter) Refresh(service *bridge.Service) error {
-	return r.Register(service)
+func (r *EtcdAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	return r.Register(ctx, service)
+}
+
+func (r *EtcdAdapter) Services(ctx context.Context) ([]*bridge.Service, error) {
+	var services []*bridge.Service
+	err := bridge.Await(ctx, func() error {
+		var err error
+		services, err = r.services()
+		return err
+	})
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	return services, nil
 }
 
-func (r *EtcdAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+func (r *EtcdAdapter) services() ([]*bridge.Service, error) {
+	if err := r.connect(); err != nil {
+		return []*bridge.Service{}, err
+	}
+	r.syncEtcdCluster()
+
+	// collect every value below the prefix from either client
+	values := make(map[string]string)
+	if r.client != nil {
+		res, err := r.client.Get(r.path, false, true)
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == keyNotFound {
+			return []*bridge.Service{}, nil
+		} else if err != nil {
+			return []*bridge.Service{}, err
+		}
+		var walk func(nodes etcd.Nodes)
+		walk = func(nodes etcd.Nodes) {
+			for _, node := range nodes {
+				if node.Dir {
+					walk(node.Nodes)
+				} else {
+					values[node.Key] = node.Value
+				}
+			}
+		}
+		walk(res.Node.Nodes)
+	} else {
+		res, err := r.client2.Get(r.path, false, true)
+		if e, ok := err.(*etcd2.EtcdError); ok && e.ErrorCode == keyNotFound {
+			return []*bridge.Service{}, nil
+		} else if err != nil {
+			return []*bridge.Service{}, err
+		}
+		var walk func(nodes etcd2.Nodes)
+		walk = func(nodes etcd2.Nodes) {
+			for _, node := range nodes {
+				if node.Dir {
+					walk(node.Nodes)
+				} else {
+					values[node.Key] = node.Value
+				}
+			}
+		}
+		walk(res.Node.Nodes)
+	}
+
+	return r.format.Parse(r.path, r.layout, values, func(key string, err error) {
+		log.Println("etcd: skipping", key+":", err)
+	}), nil
+}
+
+// servicePaths returns every key the service is stored at.
+func (r *EtcdAdapter) servicePaths(service *bridge.Service) ([]string, error) {
+	keys, err := r.layout.Keys(service)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = r.path + "/" + key
+	}
+	return keys, nil
 }
@@ -0,0 +1,249 @@
+package etcd3
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/42wim/registrator-work/kv"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// MaxTxnOps is the most operations etcd accepts in a transaction by default.
+const MaxTxnOps = 128
+
+// txnItem holds the operations writing or deleting the keys of one service.
+type txnItem struct {
+	index int // of the service in the batch
+	ops   []clientv3.Op
+}
+
+// RegisterBatch writes the keys of services in as few transactions as
+// possible. Keys of services with a TTL are put under the lease of their TTL.
+func (r *Etcd3Adapter) RegisterBatch(ctx context.Context, services []*bridge.Service) []error {
+	errs := make([]error, len(services))
+	leases := make([]clientv3.LeaseID, len(services))
+	r.Lock()
+	defer r.Unlock()
+
+	failed := make(map[int]error) // TTL -> error granting its lease
+	items := make([]txnItem, 0, len(services))
+	for i, service := range services {
+		err := failed[service.TTL]
+		if err == nil {
+			if leases[i], err = r.leases.Grant(ctx, service.TTL); err != nil {
+				failed[service.TTL] = err
+			}
+		}
+		var ops []clientv3.Op
+		if err == nil {
+			ops, err = r.registerOps(service, leases[i])
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		items = append(items, txnItem{index: i, ops: ops})
+	}
+
+	r.txn(ctx, items, errs)
+	for i, service := range services {
+		if errs[i] != nil {
+			log.Println("etcd3: failed to register service:", service.ID, errs[i])
+		} else {
+			r.leases.Hold(service.ID, leases[i])
+		}
+	}
+	return errs
+}
+
+// DeregisterBatch deletes the keys of services in as few transactions as
+// possible.
+func (r *Etcd3Adapter) DeregisterBatch(ctx context.Context, services []*bridge.Service) []error {
+	errs := make([]error, len(services))
+	items := make([]txnItem, 0, len(services))
+	for i, service := range services {
+		ops, err := r.deregisterOps(service)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		items = append(items, txnItem{index: i, ops: ops})
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.txn(ctx, items, errs)
+	for i, service := range services {
+		if errs[i] != nil {
+			log.Println("etcd3: failed to deregister service:", service.ID, errs[i])
+		} else {
+			r.leases.Release(service.ID)
+		}
+	}
+	return errs
+}
+
+// Update puts the keys of service in one transaction, which with the env
+// format also deletes the keys of the attributes it no longer has. etcd
+// rejects transactions touching a key twice, so those are read first.
+func (r *Etcd3Adapter) Update(ctx context.Context, service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	err := r.update(ctx, service)
+	if err != nil {
+		log.Println("etcd3: failed to update service:", err)
+	}
+	return err
+}
+
+// update replaces the keys of service. Must be called with the lock held.
+func (r *Etcd3Adapter) update(ctx context.Context, service *bridge.Service) error {
+	lease, err := r.leases.Grant(ctx, service.TTL)
+	if err != nil {
+		return err
+	}
+	ops, err := r.registerOps(service, lease)
+	if err != nil {
+		return err
+	}
+	if r.format == kv.FormatEnv {
+		stale, err := r.staleOps(ctx, service, ops)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, stale...)
+	}
+	errs := make([]error, 1)
+	r.txn(ctx, []txnItem{{ops: ops}}, errs)
+	if errs[0] != nil {
+		return errs[0]
+	}
+	r.leases.Hold(service.ID, lease)
+	return nil
+}
+
+// staleOps returns the operations deleting the keys below the paths of
+// service that put doesn't write.
+func (r *Etcd3Adapter) staleOps(ctx context.Context, service *bridge.Service, put []clientv3.Op) ([]clientv3.Op, error) {
+	paths, err := r.servicePaths(service)
+	if err != nil {
+		return nil, bridge.Permanent(err)
+	}
+	written := make(map[string]bool, len(put))
+	for _, op := range put {
+		written[string(op.KeyBytes())] = true
+	}
+	var ops []clientv3.Op
+	for _, path := range paths {
+		res, err := r.client.Get(ctx, path+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+		if err != nil {
+			return nil, Classify(err)
+		}
+		for _, pair := range res.Kvs {
+			if !written[string(pair.Key)] {
+				ops = append(ops, clientv3.OpDelete(string(pair.Key)))
+			}
+		}
+	}
+	return ops, nil
+}
+
+// Health reports an error once a lease of the keys of services with a TTL
+// expired.
+func (r *Etcd3Adapter) Health(ctx context.Context) error {
+	r.Lock()
+	leases := r.leases.IDs()
+	r.Unlock()
+	for _, lease := range leases {
+		res, err := r.client.TimeToLive(ctx, lease)
+		if err != nil {
+			return Classify(err)
+		}
+		if res.TTL <= 0 {
+			return fmt.Errorf("etcd3: lease %x expired", lease)
+		}
+	}
+	return nil
+}
+
+// registerOps returns the operations putting the keys of service, with
+// lease unless it is 0.
+func (r *Etcd3Adapter) registerOps(service *bridge.Service, lease clientv3.LeaseID) ([]clientv3.Op, error) {
+	paths, err := r.servicePaths(service)
+	if err != nil {
+		return nil, bridge.Permanent(err)
+	}
+	values, err := r.format.Encode(service)
+	if err != nil {
+		return nil, bridge.Permanent(err)
+	}
+	var opts []clientv3.OpOption
+	if lease != 0 {
+		opts = append(opts, clientv3.WithLease(lease))
+	}
+	ops := make([]clientv3.Op, 0, len(paths)*len(values))
+	for _, path := range paths {
+		for key, value := range values {
+			if key != "" {
+				key = path + "/" + key
+			} else {
+				key = path
+			}
+			ops = append(ops, clientv3.OpPut(key, value, opts...))
+		}
+	}
+	return ops, nil
+}
+
+// deregisterOps returns the operations deleting the keys of service.
+func (r *Etcd3Adapter) deregisterOps(service *bridge.Service) ([]clientv3.Op, error) {
+	paths, err := r.servicePaths(service)
+	if err != nil {
+		return nil, bridge.Permanent(err)
+	}
+	ops := make([]clientv3.Op, 0, len(paths))
+	for _, path := range paths {
+		if r.format == kv.FormatEnv {
+			ops = append(ops, clientv3.OpDelete(path+"/", clientv3.WithPrefix()))
+		} else {
+			ops = append(ops, clientv3.OpDelete(path))
+		}
+	}
+	return ops, nil
+}
+
+// txn runs the operations of items in transactions of at most MaxTxnOps
+// operations, never splitting the operations of an item. etcd doesn't tell
+// which operation failed, so the error of a transaction is set for all its
+// items.
+func (r *Etcd3Adapter) txn(ctx context.Context, items []txnItem, errs []error) {
+	for len(items) > 0 {
+		var chunk []txnItem
+		var ops []clientv3.Op
+		for len(items) > 0 {
+			item := items[0]
+			if len(item.ops) > MaxTxnOps {
+				errs[item.index] = bridge.Permanent(fmt.Errorf("etcd3: %d keys exceed the %d operations of a transaction", len(item.ops), MaxTxnOps))
+				items = items[1:]
+				continue
+			}
+			if len(ops)+len(item.ops) > MaxTxnOps {
+				break
+			}
+			chunk = append(chunk, item)
+			ops = append(ops, item.ops...)
+			items = items[1:]
+		}
+		if len(ops) == 0 {
+			continue
+		}
+
+		if _, err := r.client.Txn(ctx).Then(ops...).Commit(); err != nil {
+			for _, item := range chunk {
+				errs[item.index] = Classify(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package etcd3
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/42wim/registrator-work/kv"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+)
+
+// DefaultTimeout bounds dialing etcd.
+const DefaultTimeout = 5 * time.Second
+
+func init() {
+	bridge.Register(new(Factory), "etcd3")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
+	endpoints := []string{"127.0.0.1:2379"}
+	if uri.Host != "" {
+		endpoints = strings.Split(uri.Host, ",")
+	}
+	format, err := kv.ParseFormat(uri)
+	if err != nil {
+		return nil, fmt.Errorf("etcd3: %v", err)
+	}
+	layout, err := kv.ParseLayout(uri)
+	if err != nil {
+		return nil, fmt.Errorf("etcd3: %v", err)
+	}
+	if err := format.Check(layout); err != nil {
+		return nil, fmt.Errorf("etcd3: %v", err)
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: DefaultTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("etcd3: %v", err)
+	}
+	return &Etcd3Adapter{
+		client: client,
+		path:   uri.Path,
+		format: format,
+		layout: layout,
+		leases: NewLeases(client, "etcd3"),
+	}, nil
+}
+
+type Etcd3Adapter struct {
+	sync.Mutex
+	client *clientv3.Client
+	path   string
+	format kv.Format
+	layout *kv.Layout
+
+	// leases hold the keys written with a TTL, one per TTL.
+	leases *Leases
+}
+
+// Ping asks every endpoint for its status until one answers.
+func (r *Etcd3Adapter) Ping(ctx context.Context) error {
+	var err error
+	for _, endpoint := range r.client.Endpoints() {
+		var status *clientv3.StatusResponse
+		status, err = r.client.Status(ctx, endpoint)
+		if err == nil {
+			log.Println("etcd3: connected to", endpoint, "version", status.Version)
+			return nil
+		}
+	}
+	return err
+}
+
+func (r *Etcd3Adapter) Register(ctx context.Context, service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	err := r.put(ctx, service)
+	if err != nil {
+		log.Println("etcd3: failed to register service:", err)
+	}
+	return err
+}
+
+func (r *Etcd3Adapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	ops, err := r.deregisterOps(service)
+	if err != nil {
+		log.Println("etcd3: failed to deregister service:", err)
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.leases.Release(service.ID)
+	_, err = r.client.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		log.Println("etcd3: failed to deregister service:", err)
+	}
+	return Classify(err)
+}
+
+// Refresh keeps the lease of the service's keys alive. If the lease expired
+// in the meantime, the keys are written again under a new one.
+func (r *Etcd3Adapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	if service.TTL == 0 {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	alive, err := r.leases.KeepAlive(ctx, service.ID, service.TTL)
+	if err != nil {
+		log.Println("etcd3: failed to keep lease alive:", err)
+		return err
+	}
+	if alive {
+		return nil
+	}
+	err = r.put(ctx, service)
+	if err != nil {
+		log.Println("etcd3: failed to register service:", err)
+	}
+	return err
+}
+
+func (r *Etcd3Adapter) Services(ctx context.Context) ([]*bridge.Service, error) {
+	res, err := r.client.Get(ctx, r.path+"/", clientv3.WithPrefix())
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	values := make(map[string]string, len(res.Kvs))
+	for _, pair := range res.Kvs {
+		values[string(pair.Key)] = string(pair.Value)
+	}
+	return r.format.Parse(r.path, r.layout, values, func(key string, err error) {
+		log.Println("etcd3: skipping", key+":", err)
+	}), nil
+}
+
+// put writes all keys of service in one transaction, under the lease of
+// its TTL if it has one. Must be called with the lock held.
+func (r *Etcd3Adapter) put(ctx context.Context, service *bridge.Service) error {
+	lease, err := r.leases.Grant(ctx, service.TTL)
+	if err != nil {
+		return err
+	}
+	ops, err := r.registerOps(service, lease)
+	if err != nil {
+		return err
+	}
+	if _, err := r.client.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return Classify(err)
+	}
+	r.leases.Hold(service.ID, lease)
+	return nil
+}
+
+// servicePaths returns every key the service is stored at.
+func (r *Etcd3Adapter) servicePaths(service *bridge.Service) ([]string, error) {
+	keys, err := r.layout.Keys(service)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = r.path + "/" + key
+	}
+	return keys, nil
+}
+
+// Classify marks the requests etcd rejects as invalid or unauthorized as
+// permanent.
+func Classify(err error) error {
+	e, ok := rpctypes.Error(err).(rpctypes.EtcdError)
+	if !ok {
+		return err
+	}
+	switch e.Code() {
+	case codes.InvalidArgument, codes.PermissionDenied, codes.Unauthenticated:
+		return bridge.Permanent(err)
+	}
+	return err
+}
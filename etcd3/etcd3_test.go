@@ -0,0 +1,140 @@
+package etcd3
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/42wim/registrator-work/internal/etcdtest"
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func newAdapter(t *testing.T, uri string) *Etcd3Adapter {
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := new(Factory).New(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter := registry.(*Etcd3Adapter)
+	t.Cleanup(func() { adapter.client.Close() })
+	return adapter
+}
+
+func testService() *bridge.Service {
+	return &bridge.Service{
+		ID:   "host:web:80",
+		Name: "web",
+		IP:   "10.0.0.2",
+		Port: 8080,
+		Tags: []string{"a", "b"},
+	}
+}
+
+func TestRegisterDeregister(t *testing.T) {
+	ctx := context.Background()
+	adapter := newAdapter(t, "etcd3://"+etcdtest.Start(t)+"/services?format=json")
+	assert.NoError(t, adapter.Ping(ctx))
+
+	assert.NoError(t, adapter.Register(ctx, testService()))
+	services, err := adapter.Services(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+	assert.Equal(t, "host:web:80", services[0].ID)
+	assert.Equal(t, []string{"a", "b"}, services[0].Tags)
+
+	assert.NoError(t, adapter.Deregister(ctx, testService()))
+	services, err = adapter.Services(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, services)
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	adapter := newAdapter(t, "etcd3://"+etcdtest.Start(t)+"/services?format=env")
+	service := testService()
+	service.Attrs = map[string]string{"region": "us-east", "zone": "a"}
+	assert.NoError(t, adapter.Register(ctx, service))
+
+	service.Port = 8081
+	service.Attrs = map[string]string{"region": "eu-west"}
+	assert.NoError(t, adapter.Update(ctx, service))
+
+	res, err := adapter.client.Get(ctx, "/services/web/host:web:80/", clientv3.WithPrefix())
+	assert.NoError(t, err)
+	values := make(map[string]string)
+	for _, pair := range res.Kvs {
+		values[string(pair.Key)] = string(pair.Value)
+	}
+	assert.Equal(t, "8081", values["/services/web/host:web:80/port"])
+	assert.Equal(t, "eu-west", values["/services/web/host:web:80/attrs/region"])
+	assert.NotContains(t, values, "/services/web/host:web:80/attrs/zone")
+
+	services, err := adapter.Services(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+	assert.Equal(t, service.Attrs, services[0].Attrs)
+}
+
+func TestMultipleKeys(t *testing.T) {
+	ctx := context.Background()
+	key := url.QueryEscape("{{.Name}}/{{.Tag}}/{{.ID}}")
+	adapter := newAdapter(t, "etcd3://"+etcdtest.Start(t)+"/services?key="+key)
+
+	assert.NoError(t, adapter.Register(ctx, testService()))
+	res, err := adapter.client.Get(ctx, "/services/", clientv3.WithPrefix())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), res.Count)
+
+	services, err := adapter.Services(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+	assert.ElementsMatch(t, []string{"a", "b"}, services[0].Tags)
+
+	assert.NoError(t, adapter.Deregister(ctx, testService()))
+	res, err = adapter.client.Get(ctx, "/services/", clientv3.WithPrefix())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), res.Count)
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	adapter := newAdapter(t, "etcd3://"+etcdtest.Start(t)+"/services")
+	service := testService()
+	service.TTL = 30
+	other := &bridge.Service{ID: "host:db:5432", Name: "db", IP: "10.0.0.3", Port: 5432, TTL: 60}
+
+	assert.NoError(t, adapter.Register(ctx, service))
+	assert.NoError(t, adapter.Register(ctx, other))
+
+	// one lease per TTL
+	lease := leaseOf(t, adapter, "/services/web/host:web:80")
+	assert.NotZero(t, lease)
+	for key, ttl := range map[string]int64{"/services/web/host:web:80": 30, "/services/db/host:db:5432": 60} {
+		res, err := adapter.client.TimeToLive(ctx, leaseOf(t, adapter, key))
+		assert.NoError(t, err)
+		assert.Equal(t, ttl, res.GrantedTTL, key)
+	}
+
+	// the keys come back under a new lease once the old one is gone
+	_, err := adapter.client.Revoke(ctx, lease)
+	assert.NoError(t, err)
+	adapter.leases.leases[30].renewed = time.Time{}
+	assert.NoError(t, adapter.Refresh(ctx, service))
+	assert.NotEqual(t, lease, leaseOf(t, adapter, "/services/web/host:web:80"))
+	assert.NoError(t, adapter.Health(ctx))
+}
+
+// leaseOf returns the lease key was put with.
+func leaseOf(t *testing.T, adapter *Etcd3Adapter, key string) clientv3.LeaseID {
+	res, err := adapter.client.Get(context.Background(), key)
+	if err != nil || len(res.Kvs) == 0 {
+		t.Fatal("no key", key, err)
+	}
+	return clientv3.LeaseID(res.Kvs[0].Lease)
+}
@@ -0,0 +1,97 @@
+package etcd3
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Leases holds one lease per TTL, shared by all keys written with that TTL
+// and kept alive by refreshing their services, so that etcd deletes the
+// keys once registrator stops. It is not safe for concurrent use, adapters
+// call it with their lock held.
+type Leases struct {
+	client *clientv3.Client
+	name   string // of the adapter, in logs
+
+	leases map[int]*lease              // by TTL
+	held   map[string]clientv3.LeaseID // service ID -> lease its keys were put with
+}
+
+type lease struct {
+	id      clientv3.LeaseID
+	renewed time.Time
+}
+
+func NewLeases(client *clientv3.Client, name string) *Leases {
+	return &Leases{
+		client: client,
+		name:   name,
+		leases: make(map[int]*lease),
+		held:   make(map[string]clientv3.LeaseID),
+	}
+}
+
+// Grant returns the lease of ttl, granting it first if needed. Without a
+// TTL there is no lease and it returns 0.
+func (l *Leases) Grant(ctx context.Context, ttl int) (clientv3.LeaseID, error) {
+	if ttl == 0 {
+		return 0, nil
+	}
+	if lease := l.leases[ttl]; lease != nil {
+		return lease.id, nil
+	}
+	res, err := l.client.Grant(ctx, int64(ttl))
+	if err != nil {
+		return 0, Classify(err)
+	}
+	log.Printf("%s: granted lease %x with ttl %ds", l.name, res.ID, ttl)
+	l.leases[ttl] = &lease{id: res.ID, renewed: time.Now()}
+	return res.ID, nil
+}
+
+// Hold records that the keys of the service were put with lease.
+func (l *Leases) Hold(id string, lease clientv3.LeaseID) {
+	l.held[id] = lease
+}
+
+// Release forgets the lease of the keys of the service.
+func (l *Leases) Release(id string) {
+	delete(l.held, id)
+}
+
+// KeepAlive keeps the lease of ttl alive, at most once a second since the
+// services sharing it are refreshed close to each other. It reports whether
+// the keys of the service are held by that lease. If not, e.g. because it
+// expired, they have to be put again.
+func (l *Leases) KeepAlive(ctx context.Context, id string, ttl int) (bool, error) {
+	lease := l.leases[ttl]
+	if lease == nil {
+		return false, nil
+	}
+	if time.Since(lease.renewed) > time.Second {
+		_, err := l.client.KeepAliveOnce(ctx, lease.id)
+		if err == rpctypes.ErrLeaseNotFound {
+			log.Printf("%s: lease %x expired", l.name, lease.id)
+			delete(l.leases, ttl)
+			return false, nil
+		}
+		if err != nil {
+			return false, Classify(err)
+		}
+		lease.renewed = time.Now()
+	}
+	return l.held[id] == lease.id, nil
+}
+
+// IDs returns the leases granted so far.
+func (l *Leases) IDs() []clientv3.LeaseID {
+	ids := make([]clientv3.LeaseID, 0, len(l.leases))
+	for _, lease := range l.leases {
+		ids = append(ids, lease.id)
+	}
+	return ids
+}
@@ -0,0 +1,361 @@
+package eureka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/42wim/registrator-work/bridge"
+)
+
+const (
+	// DefaultPath is the base of the REST API unless the URI has a path.
+	DefaultPath = "/eureka"
+
+	// DefaultLease is the lease duration of instances without a TTL,
+	// which is also what Eureka assumes.
+	DefaultLease = 90
+)
+
+func init() {
+	f := new(Factory)
+	bridge.Register(f, "eureka")
+	bridge.Register(f, "eurekas")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
+	base := *uri
+	base.Scheme = "http"
+	if uri.Scheme == "eurekas" {
+		base.Scheme = "https"
+	}
+	if base.Host == "" {
+		base.Host = "127.0.0.1:8761"
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	if base.Path == "" {
+		base.Path = DefaultPath
+	}
+	base.RawQuery = ""
+	// sent as basic authentication instead, so that the password doesn't
+	// end up in errors and logs along with the URL
+	base.User = nil
+	return &EurekaAdapter{client: http.DefaultClient, url: base.String(), user: uri.User}, nil
+}
+
+// EurekaAdapter registers services as instances of the Eureka application
+// of their name through the REST API.
+type EurekaAdapter struct {
+	client *http.Client
+	url    string
+	user   *url.Userinfo
+	warned sync.Once
+}
+
+// Instance is an instance as Eureka reads and writes it.
+type Instance struct {
+	InstanceID       string            `json:"instanceId"`
+	HostName         string            `json:"hostName"`
+	App              string            `json:"app"`
+	IPAddr           string            `json:"ipAddr"`
+	VIPAddress       string            `json:"vipAddress"`
+	SecureVIPAddress string            `json:"secureVipAddress"`
+	Status           string            `json:"status"`
+	Port             Port              `json:"port"`
+	SecurePort       Port              `json:"securePort"`
+	DataCenterInfo   DataCenterInfo    `json:"dataCenterInfo"`
+	LeaseInfo        *LeaseInfo        `json:"leaseInfo,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+}
+
+// Port is a port of an instance, which may be disabled.
+type Port struct {
+	Port    int
+	Enabled bool
+}
+
+func (p Port) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{"$": p.Port, "@enabled": strconv.FormatBool(p.Enabled)})
+}
+
+// UnmarshalJSON reads a port with the number and flag either as strings or
+// not, since Eureka versions differ.
+func (p *Port) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Port    json.RawMessage `json:"$"`
+		Enabled json.RawMessage `json:"@enabled"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(strings.Trim(string(raw.Port), `"`))
+	if err != nil {
+		return fmt.Errorf("invalid port %s", raw.Port)
+	}
+	p.Port = port
+	p.Enabled = strings.Trim(string(raw.Enabled), `"`) == "true"
+	return nil
+}
+
+type DataCenterInfo struct {
+	Class string `json:"@class"`
+	Name  string `json:"name"`
+}
+
+type LeaseInfo struct {
+	RenewalIntervalInSecs int `json:"renewalIntervalInSecs,omitempty"`
+	DurationInSecs        int `json:"durationInSecs,omitempty"`
+}
+
+// Ping asks for the latest changes of the registry, which is cheaper than
+// asking for all of it.
+func (r *EurekaAdapter) Ping(ctx context.Context) error {
+	return r.do(ctx, "GET", "/apps/delta", nil, nil)
+}
+
+func (r *EurekaAdapter) Register(ctx context.Context, service *bridge.Service) error {
+	if service.TTL == 0 {
+		r.warned.Do(func() {
+			log.Printf("eureka: services have no TTL, Eureka evicts them after %ds without heartbeats; run with -ttl and -ttl-refresh", DefaultLease)
+		})
+	}
+	body, err := json.Marshal(map[string]*Instance{"instance": newInstance(service)})
+	if err != nil {
+		return bridge.Permanent(err)
+	}
+	err = r.do(ctx, "POST", "/apps/"+url.PathEscape(appName(service.Name)), body, nil)
+	if err != nil {
+		log.Println("eureka: failed to register service:", err)
+	}
+	return err
+}
+
+func (r *EurekaAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	err := r.do(ctx, "DELETE", r.instancePath(service), nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		log.Println("eureka: failed to deregister service:", err)
+	}
+	return err
+}
+
+// Refresh sends a heartbeat for the instance. If Eureka doesn't know it,
+// e.g. because it was evicted, it is registered again.
+func (r *EurekaAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	err := r.do(ctx, "PUT", r.instancePath(service), nil, nil)
+	if isNotFound(err) {
+		log.Println("eureka: instance unknown, registering again:", service.ID)
+		return r.Register(ctx, service)
+	}
+	if err != nil {
+		log.Println("eureka: failed to send heartbeat:", err)
+	}
+	return err
+}
+
+// Services lists the instances of all applications.
+func (r *EurekaAdapter) Services(ctx context.Context) ([]*bridge.Service, error) {
+	var res struct {
+		Applications struct {
+			Application list `json:"application"`
+		} `json:"applications"`
+	}
+	if err := r.do(ctx, "GET", "/apps", nil, &res); err != nil {
+		return []*bridge.Service{}, err
+	}
+
+	services := make([]*bridge.Service, 0)
+	for _, raw := range res.Applications.Application {
+		var app struct {
+			Instance list `json:"instance"`
+		}
+		if err := json.Unmarshal(raw, &app); err != nil {
+			log.Println("eureka: skipping application:", err)
+			continue
+		}
+		for _, raw := range app.Instance {
+			var instance Instance
+			if err := json.Unmarshal(raw, &instance); err != nil {
+				log.Println("eureka: skipping instance:", err)
+				continue
+			}
+			services = append(services, instance.service())
+		}
+	}
+	return services, nil
+}
+
+func (r *EurekaAdapter) instancePath(service *bridge.Service) string {
+	return "/apps/" + url.PathEscape(appName(service.Name)) + "/" + url.PathEscape(service.ID)
+}
+
+// do sends a request to path below the base URL and decodes the response
+// into v, if given.
+func (r *EurekaAdapter) do(ctx context.Context, method, path string, body []byte, v interface{}) error {
+	req, err := http.NewRequest(method, r.url+path, bytes.NewReader(body))
+	if err != nil {
+		return bridge.Permanent(err)
+	}
+	if r.user != nil {
+		password, _ := r.user.Password()
+		req.SetBasicAuth(r.user.Username(), password)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, res.Body)
+		err := &statusError{method: method, url: req.URL.String(), status: res.Status, code: res.StatusCode}
+		if bridge.PermanentStatus(err.code) {
+			return bridge.Permanent(err)
+		}
+		return err
+	}
+	if v == nil {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("eureka: invalid response to %s %s: %v", method, req.URL, err)
+	}
+	return nil
+}
+
+type statusError struct {
+	method, url, status string
+	code                int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.method, e.url, e.status)
+}
+
+func isNotFound(err error) bool {
+	var status *statusError
+	return errors.As(err, &status) && status.code == http.StatusNotFound
+}
+
+// list is a JSON list that older Eureka versions render as a single
+// object when it has one element.
+type list []json.RawMessage
+
+func (l *list) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return json.Unmarshal(data, (*[]json.RawMessage)(l))
+	}
+	*l = list{json.RawMessage(data)}
+	return nil
+}
+
+// newInstance maps service to an instance of the application of its name:
+//
+//	eureka_port=<port>         the plain port instead of the service port
+//	eureka_secure_port=<port>  enables the secure port
+//
+// A service tagged secure is registered with its port as the secure port,
+// and without a plain port unless eureka_port is set. The other attributes
+// are the metadata of the instance.
+func newInstance(service *bridge.Service) *Instance {
+	ip := strings.Trim(service.IP, "[]")
+	instance := &Instance{
+		InstanceID:       service.ID,
+		HostName:         ip,
+		App:              appName(service.Name),
+		IPAddr:           ip,
+		VIPAddress:       service.Name,
+		SecureVIPAddress: service.Name,
+		Status:           status(service.Origin.Health),
+		Port:             Port{Port: service.Port, Enabled: true},
+		DataCenterInfo: DataCenterInfo{
+			Class: "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo",
+			Name:  "MyOwn",
+		},
+		LeaseInfo: &LeaseInfo{DurationInSecs: DefaultLease},
+	}
+	if service.TTL > 0 {
+		instance.LeaseInfo.DurationInSecs = service.TTL
+	}
+	for _, tag := range service.Tags {
+		if tag == "secure" {
+			instance.SecurePort = Port{Port: service.Port, Enabled: true}
+			instance.Port = Port{Port: service.Port}
+		}
+	}
+	for key, value := range service.Attrs {
+		port, err := strconv.Atoi(value)
+		switch {
+		case key == "eureka_port" && err == nil:
+			instance.Port = Port{Port: port, Enabled: true}
+		case key == "eureka_secure_port" && err == nil:
+			instance.SecurePort = Port{Port: port, Enabled: true}
+		case strings.HasPrefix(key, "eureka_"):
+			log.Printf("eureka: ignoring %s=%q of %s", key, value, service.ID)
+		default:
+			if instance.Metadata == nil {
+				instance.Metadata = make(map[string]string)
+			}
+			instance.Metadata[key] = value
+		}
+	}
+	return instance
+}
+
+// service maps an instance back to a service, using its plain port if
+// enabled and its secure port otherwise.
+func (i *Instance) service() *bridge.Service {
+	name := i.VIPAddress
+	if name == "" {
+		name = strings.ToLower(i.App)
+	}
+	port := i.Port.Port
+	if !i.Port.Enabled && i.SecurePort.Enabled {
+		port = i.SecurePort.Port
+	}
+	return &bridge.Service{
+		ID:    i.InstanceID,
+		Name:  name,
+		IP:    i.IPAddr,
+		Port:  port,
+		Attrs: i.Metadata,
+	}
+}
+
+// appName returns the Eureka application of a service name, which Eureka
+// upper-cases.
+func appName(name string) string {
+	return strings.ToUpper(name)
+}
+
+// status maps the status of the container's health check to the status of
+// the instance, so that clients only pick healthy instances.
+func status(health string) string {
+	switch health {
+	case "starting":
+		return "STARTING"
+	case "unhealthy":
+		return "DOWN"
+	default:
+		return "UP"
+	}
+}
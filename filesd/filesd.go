@@ -0,0 +1,263 @@
+package filesd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/42wim/registrator-work/internal/atomicfile"
+	"github.com/cenkalti/backoff"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultDelay is how long a write waits for more changes unless configured
+// otherwise, so that containers started together cause a single write.
+const DefaultDelay = time.Second
+
+// MaxRetryDelay bounds the backoff between attempts of a failed delayed
+// write.
+const MaxRetryDelay = time.Minute
+
+func init() {
+	bridge.Register(new(Factory), "filesd")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
+	if uri.Path == "" || strings.HasSuffix(uri.Path, "/") {
+		return nil, errors.New("filesd: file required e.g.: filesd:///etc/prometheus/targets.json")
+	}
+	query := uri.Query()
+
+	yamlFormat := false
+	switch format := query.Get("format"); format {
+	case "":
+		ext := filepath.Ext(uri.Path)
+		yamlFormat = ext == ".yml" || ext == ".yaml"
+	case "json":
+	case "yaml":
+		yamlFormat = true
+	default:
+		return nil, fmt.Errorf("filesd: unknown format %q, want \"json\" or \"yaml\"", format)
+	}
+
+	delay := DefaultDelay
+	if value := query.Get("delay"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("filesd: invalid delay %q", value)
+		}
+		delay = d
+	}
+
+	retry := backoff.NewExponentialBackOff()
+	retry.MaxInterval = MaxRetryDelay
+	retry.MaxElapsedTime = 0
+	return &FilesdAdapter{
+		path:     uri.Path,
+		yaml:     yamlFormat,
+		tag:      query.Get("tag"),
+		delay:    delay,
+		retry:    retry,
+		services: make(map[string]*bridge.Service),
+	}, nil
+}
+
+// FilesdAdapter keeps a Prometheus file_sd_config target file up to date
+// with the registered services.
+type FilesdAdapter struct {
+	sync.Mutex
+	path  string
+	yaml  bool
+	tag   string // only services with this tag are targets, if set
+	delay time.Duration
+
+	services map[string]*bridge.Service // by service ID
+	timer    *time.Timer                // pending write, if any
+	retry    backoff.BackOff            // delays of the attempts of a failed write
+	started  bool
+}
+
+// targetGroup is an entry of a file_sd_config target file.
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// Ping checks that the directory of the target file exists. The first
+// successful call schedules a write, so that targets left in the file from
+// before Registrator started are replaced even if no service is registered.
+func (r *FilesdAdapter) Ping(ctx context.Context) error {
+	dir := filepath.Dir(r.path)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("filesd: %v", err)
+	}
+	if !info.IsDir() {
+		return bridge.Permanent(fmt.Errorf("filesd: %s is not a directory", dir))
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.started {
+		return nil
+	}
+	r.started = true
+	return r.schedule()
+}
+
+func (r *FilesdAdapter) Register(ctx context.Context, service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.tag != "" && !hasTag(service, r.tag) {
+		if _, ok := r.services[service.ID]; ok {
+			delete(r.services, service.ID)
+			return r.schedule()
+		}
+		return nil
+	}
+	r.services[service.ID] = service
+	return r.schedule()
+}
+
+func (r *FilesdAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.services[service.ID]; !ok {
+		return nil
+	}
+	delete(r.services, service.ID)
+	return r.schedule()
+}
+
+// schedule writes the file once no change was made for the delay, or right
+// away without a delay. Must be called with the lock held.
+func (r *FilesdAdapter) schedule() error {
+	if r.delay == 0 {
+		return r.write()
+	}
+	r.writeAfter(r.delay)
+	return nil
+}
+
+// writeAfter (re)starts the timer of the pending write. A failed write is
+// attempted again with backoff, until it succeeds or a change reschedules
+// it. Must be called with the lock held.
+func (r *FilesdAdapter) writeAfter(delay time.Duration) {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		r.Lock()
+		defer r.Unlock()
+		if r.timer != timer {
+			// rescheduled after the timer fired
+			return
+		}
+		r.timer = nil
+		if err := r.write(); err != nil {
+			retry := r.retry.NextBackOff()
+			log.Printf("filesd: failed to write targets, retrying in %v: %v", retry, err)
+			r.writeAfter(retry)
+			return
+		}
+		r.retry.Reset()
+	})
+	r.timer = timer
+}
+
+// write replaces the target file through a temporary file in the same
+// directory, so that Prometheus never reads a partial file. Must be called
+// with the lock held.
+func (r *FilesdAdapter) write() error {
+	groups := targetGroups(r.services)
+	var data []byte
+	var err error
+	if r.yaml {
+		data, err = yaml.Marshal(groups)
+	} else {
+		data, err = json.MarshalIndent(groups, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return bridge.Permanent(err)
+	}
+
+	return atomicfile.WriteFile(r.path, data)
+}
+
+// targetGroups groups the services by name and labels, sorted so that the
+// file only changes with the services.
+func targetGroups(services map[string]*bridge.Service) []targetGroup {
+	byKey := make(map[string]*targetGroup)
+	for _, service := range services {
+		labels := serviceLabels(service)
+		key, _ := json.Marshal(labels) // maps are encoded sorted by key
+		group := byKey[string(key)]
+		if group == nil {
+			group = &targetGroup{Labels: labels}
+			byKey[string(key)] = group
+		}
+		group.Targets = append(group.Targets, net.JoinHostPort(strings.Trim(service.IP, "[]"), strconv.Itoa(service.Port)))
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	groups := make([]targetGroup, 0, len(keys))
+	for _, key := range keys {
+		group := byKey[key]
+		sort.Strings(group.Targets)
+		groups = append(groups, *group)
+	}
+	return groups
+}
+
+var invalidLabel = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// serviceLabels returns the labels of service: its name as job, its tags
+// joined like Prometheus' service discoveries do, and its attributes.
+func serviceLabels(service *bridge.Service) map[string]string {
+	labels := make(map[string]string, len(service.Attrs)+2)
+	for key, value := range service.Attrs {
+		if key == "" {
+			continue
+		}
+		name := invalidLabel.ReplaceAllString(key, "_")
+		if name[0] >= '0' && name[0] <= '9' {
+			name = "_" + name
+		}
+		labels[name] = value
+	}
+	labels["job"] = service.Name
+	if len(service.Tags) > 0 {
+		labels["tags"] = "," + strings.Join(service.Tags, ",") + ","
+	}
+	return labels
+}
+
+func hasTag(service *bridge.Service, tag string) bool {
+	for _, t := range service.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
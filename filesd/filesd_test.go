@@ -0,0 +1,165 @@
+package filesd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/cenkalti/backoff"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAdapter(t *testing.T, file, query string) *FilesdAdapter {
+	path := filepath.Join(t.TempDir(), file)
+	adapter, err := new(Factory).New(&url.URL{Scheme: "filesd", Path: path, RawQuery: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := adapter.(*FilesdAdapter)
+	assert.NoError(t, r.Ping(context.Background()))
+	return r
+}
+
+func read(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFactoryErrors(t *testing.T) {
+	for query, expected := range map[string]string{
+		"format=xml": `filesd: unknown format "xml", want "json" or "yaml"`,
+		"delay=soon": `filesd: invalid delay "soon"`,
+	} {
+		_, err := new(Factory).New(&url.URL{Scheme: "filesd", Path: "/tmp/targets.json", RawQuery: query})
+		assert.EqualError(t, err, expected)
+	}
+	_, err := new(Factory).New(&url.URL{Scheme: "filesd", Path: "/tmp/"})
+	assert.Error(t, err)
+}
+
+func TestWriteJSON(t *testing.T) {
+	r := newAdapter(t, "targets.json", "delay=0")
+	ctx := context.Background()
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.3", Port: 80, Tags: []string{"metrics"}}))
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "web2", Name: "web", IP: "10.0.0.2", Port: 80, Tags: []string{"metrics"}}))
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "db1", Name: "db", IP: "2001:db8::1", Port: 9187,
+		Attrs: map[string]string{"region": "us-east", "check-http": "/"}}))
+
+	assert.Equal(t, `[
+  {
+    "targets": [
+      "[2001:db8::1]:9187"
+    ],
+    "labels": {
+      "check_http": "/",
+      "job": "db",
+      "region": "us-east"
+    }
+  },
+  {
+    "targets": [
+      "10.0.0.2:80",
+      "10.0.0.3:80"
+    ],
+    "labels": {
+      "job": "web",
+      "tags": ",metrics,"
+    }
+  }
+]
+`, read(t, r.path))
+
+	assert.NoError(t, r.Deregister(ctx, &bridge.Service{ID: "db1"}))
+	assert.NotContains(t, read(t, r.path), "db")
+}
+
+func TestWriteYAML(t *testing.T) {
+	r := newAdapter(t, "targets.yml", "delay=0")
+
+	assert.NoError(t, r.Register(context.Background(), &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80}))
+
+	assert.Equal(t, `- targets:
+  - 10.0.0.2:80
+  labels:
+    job: web
+`, read(t, r.path))
+}
+
+func TestTagFilter(t *testing.T) {
+	r := newAdapter(t, "targets.json", "delay=0&tag=metrics")
+	ctx := context.Background()
+	service := &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80, Tags: []string{"metrics"}}
+
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "db1", Name: "db", IP: "10.0.0.3", Port: 5432}))
+	assert.Equal(t, "[]\n", read(t, r.path))
+
+	assert.NoError(t, r.Register(ctx, service))
+	assert.Contains(t, read(t, r.path), "10.0.0.2:80")
+
+	// the tag was removed since
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80}))
+	assert.Equal(t, "[]\n", read(t, r.path))
+}
+
+func TestStaleTargetsReplaced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`[{"targets":["10.0.0.9:80"]}]`), 0644))
+	adapter, _ := new(Factory).New(&url.URL{Scheme: "filesd", Path: path, RawQuery: "delay=0"})
+
+	assert.NoError(t, adapter.Ping(context.Background()))
+
+	assert.Equal(t, "[]\n", read(t, path))
+}
+
+func TestDelayedWrite(t *testing.T) {
+	r := newAdapter(t, "targets.json", "delay=50ms")
+	ctx := context.Background()
+
+	for _, id := range []string{"web1", "web2", "web3"} {
+		assert.NoError(t, r.Register(ctx, &bridge.Service{ID: id, Name: "web", IP: "10.0.0.2", Port: 80}))
+	}
+	_, err := os.Stat(r.path)
+	assert.True(t, os.IsNotExist(err))
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Contains(t, read(t, r.path), "10.0.0.2:80")
+	files, _ := ioutil.ReadDir(filepath.Dir(r.path))
+	assert.Len(t, files, 1, "temporary files left behind")
+}
+
+func TestDelayPostponedByChanges(t *testing.T) {
+	r := newAdapter(t, "targets.json", "delay=100ms")
+	ctx := context.Background()
+
+	for _, id := range []string{"web1", "web2", "web3"} {
+		assert.NoError(t, r.Register(ctx, &bridge.Service{ID: id, Name: "web", IP: "10.0.0.2", Port: 80}))
+		time.Sleep(60 * time.Millisecond)
+	}
+	_, err := os.Stat(r.path)
+	assert.True(t, os.IsNotExist(err), "written before the changes settled")
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Contains(t, read(t, r.path), "10.0.0.2:80")
+}
+
+func TestFailedWriteRetried(t *testing.T) {
+	r := newAdapter(t, "targets.json", "delay=10ms")
+	r.retry = &backoff.ConstantBackOff{Interval: 10 * time.Millisecond}
+	dir := filepath.Dir(r.path)
+	assert.NoError(t, os.Remove(dir))
+
+	assert.NoError(t, r.Register(context.Background(), &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80}))
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, os.Mkdir(dir, 0755))
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Contains(t, read(t, r.path), "10.0.0.2:80")
+}
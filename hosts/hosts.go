@@ -0,0 +1,268 @@
+package hosts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/42wim/registrator-work/internal/atomicfile"
+)
+
+const (
+	beginMarker = "# BEGIN registrator"
+	endMarker   = "# END registrator"
+)
+
+func init() {
+	bridge.Register(new(Factory), "hosts")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
+	if uri.Path == "" || strings.HasSuffix(uri.Path, "/") {
+		return nil, errors.New("hosts: file required e.g.: hosts:///etc/hosts")
+	}
+	return &HostsAdapter{path: uri.Path, now: time.Now}, nil
+}
+
+// HostsAdapter maintains a block of lines in a hosts file, one per service:
+//
+//	# BEGIN registrator
+//	<ip>	<name> <id> <tag>.<name>... # id=<id> port=<port> [expires=<unix time>]
+//	# END registrator
+//
+// Lines outside the block are left alone. The comment carries what the
+// aliases can't, so that services can be read back.
+type HostsAdapter struct {
+	sync.Mutex
+	path string
+	now  func() time.Time
+}
+
+// entry is a line of the block.
+type entry struct {
+	service *bridge.Service
+	expires int64 // unix time, 0 if the entry doesn't expire
+}
+
+// Ping checks that the hosts file can be read, or created if missing.
+func (r *HostsAdapter) Ping(ctx context.Context) error {
+	_, err := os.Stat(r.path)
+	if os.IsNotExist(err) {
+		_, err = os.Stat(filepath.Dir(r.path))
+	}
+	if err != nil {
+		return fmt.Errorf("hosts: %v", err)
+	}
+	return nil
+}
+
+func (r *HostsAdapter) Register(ctx context.Context, service *bridge.Service) error {
+	return r.modify(func(entries map[string]*entry) {
+		e := &entry{service: service}
+		if service.TTL > 0 {
+			e.expires = r.now().Add(time.Duration(service.TTL) * time.Second).Unix()
+		}
+		entries[service.ID] = e
+	})
+}
+
+func (r *HostsAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	return r.modify(func(entries map[string]*entry) {
+		delete(entries, service.ID)
+	})
+}
+
+func (r *HostsAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	return r.Register(ctx, service)
+}
+
+func (r *HostsAdapter) Services(ctx context.Context) ([]*bridge.Service, error) {
+	r.Lock()
+	defer r.Unlock()
+	before, entries, after, err := r.read()
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	live := r.live(entries)
+	if len(live) < len(entries) {
+		// left behind by a registrator that stopped refreshing them
+		if err := r.write(before, byID(live), after); err != nil {
+			log.Println("hosts: unable to drop expired entries:", err)
+		}
+	}
+	services := make([]*bridge.Service, 0, len(live))
+	for _, e := range live {
+		services = append(services, e.service)
+	}
+	return services, nil
+}
+
+// modify reads the block, applies fn to its entries and writes the file
+// back with the expired entries left out.
+func (r *HostsAdapter) modify(fn func(entries map[string]*entry)) error {
+	r.Lock()
+	defer r.Unlock()
+	before, entries, after, err := r.read()
+	if err != nil {
+		return err
+	}
+	live := byID(r.live(entries))
+	fn(live)
+	return r.write(before, live, after)
+}
+
+// write replaces the file with the block of entries between the lines
+// before and after it.
+func (r *HostsAdapter) write(before []string, entries map[string]*entry, after []string) error {
+	var buf bytes.Buffer
+	for _, line := range before {
+		buf.WriteString(line + "\n")
+	}
+	buf.WriteString(beginMarker + "\n")
+	ids := make([]string, 0, len(entries))
+	for id := range entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		buf.WriteString(formatEntry(entries[id]) + "\n")
+	}
+	buf.WriteString(endMarker + "\n")
+	for _, line := range after {
+		buf.WriteString(line + "\n")
+	}
+	return atomicfile.WriteFile(r.path, buf.Bytes())
+}
+
+// live returns the entries that haven't expired.
+func (r *HostsAdapter) live(entries []*entry) []*entry {
+	now := r.now().Unix()
+	var live []*entry
+	for _, e := range entries {
+		if e.expires == 0 || e.expires > now {
+			live = append(live, e)
+		}
+	}
+	return live
+}
+
+// byID indexes entries by service ID.
+func byID(entries []*entry) map[string]*entry {
+	m := make(map[string]*entry, len(entries))
+	for _, e := range entries {
+		m[e.service.ID] = e
+	}
+	return m
+}
+
+// read returns the lines of the file before the block, the entries of the
+// block and the lines after it. A missing file is empty.
+func (r *HostsAdapter) read() (before []string, entries []*entry, after []string, err error) {
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	inBlock, seen := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case !seen && strings.TrimSpace(line) == beginMarker:
+			inBlock, seen = true, true
+		case inBlock && strings.TrimSpace(line) == endMarker:
+			inBlock = false
+		case inBlock:
+			e, err := parseEntry(line)
+			if err != nil {
+				log.Println("hosts: dropping", strconv.Quote(line)+":", err)
+				continue
+			}
+			entries = append(entries, e)
+		case seen:
+			after = append(after, line)
+		default:
+			before = append(before, line)
+		}
+	}
+	if inBlock {
+		return nil, nil, nil, bridge.Permanent(fmt.Errorf("hosts: %s has no %q line", r.path, endMarker))
+	}
+	return before, entries, after, scanner.Err()
+}
+
+func formatEntry(e *entry) string {
+	service := e.service
+	names := []string{service.Name}
+	if id := label(service.ID); id != service.Name {
+		names = append(names, id)
+	}
+	for _, tag := range service.Tags {
+		names = append(names, tag+"."+service.Name)
+	}
+	line := fmt.Sprintf("%s\t%s # id=%s port=%d", strings.Trim(service.IP, "[]"), strings.Join(names, " "), service.ID, service.Port)
+	if e.expires != 0 {
+		line += fmt.Sprintf(" expires=%d", e.expires)
+	}
+	return line
+}
+
+func parseEntry(line string) (*entry, error) {
+	parts := strings.SplitN(line, "#", 2)
+	names := strings.Fields(parts[0])
+	if len(names) < 2 || len(parts) != 2 {
+		return nil, errors.New("not a service")
+	}
+	service := &bridge.Service{IP: names[0], Name: names[1]}
+	e := &entry{service: service}
+	for _, field := range strings.Fields(parts[1]) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		var err error
+		switch kv[0] {
+		case "id":
+			service.ID = kv[1]
+		case "port":
+			service.Port, err = strconv.Atoi(kv[1])
+		case "expires":
+			e.expires, err = strconv.ParseInt(kv[1], 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s", kv[0])
+		}
+	}
+	if service.ID == "" {
+		return nil, errors.New("no service ID")
+	}
+	for _, name := range names[2:] {
+		if tag := strings.TrimSuffix(name, "."+service.Name); tag != name {
+			service.Tags = append(service.Tags, tag)
+		}
+	}
+	return e, nil
+}
+
+// label turns a service ID into a hostname.
+func label(id string) string {
+	return strings.Replace(id, ":", "-", -1)
+}
@@ -0,0 +1,130 @@
+package hosts
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/stretchr/testify/assert"
+)
+
+const hostsFile = `127.0.0.1	localhost
+::1	localhost ip6-localhost
+`
+
+// newAdapter returns an adapter for a hosts file in a temporary directory
+// with the content, and the path of that file.
+func newAdapter(t *testing.T, content string) (*HostsAdapter, string) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	adapter, err := new(Factory).New(&url.URL{Scheme: "hosts", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := adapter.(*HostsAdapter)
+	r.now = func() time.Time { return time.Unix(1000, 0) }
+	assert.NoError(t, r.Ping(context.Background()))
+	return r, path
+}
+
+func read(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRegister(t *testing.T) {
+	r, path := newAdapter(t, hostsFile)
+	ctx := context.Background()
+
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "host:redis:6379", Name: "redis", IP: "10.0.0.2", Port: 6379, Tags: []string{"master"}}))
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "db1", Name: "db", IP: "[2001:db8::1]", Port: 5432, TTL: 30}))
+
+	assert.Equal(t, hostsFile+`# BEGIN registrator
+2001:db8::1	db db1 # id=db1 port=5432 expires=1030
+10.0.0.2	redis host-redis-6379 master.redis # id=host:redis:6379 port=6379
+# END registrator
+`, read(t, path))
+
+	assert.NoError(t, r.Deregister(ctx, &bridge.Service{ID: "db1"}))
+	assert.NoError(t, r.Deregister(ctx, &bridge.Service{ID: "host:redis:6379"}))
+
+	assert.Equal(t, hostsFile+"# BEGIN registrator\n# END registrator\n", read(t, path))
+}
+
+func TestLinesAroundBlockPreserved(t *testing.T) {
+	content := hostsFile + `# BEGIN registrator
+10.0.0.2	redis # id=redis1 port=6379
+# END registrator
+192.168.1.1	router
+`
+	r, path := newAdapter(t, content)
+
+	assert.NoError(t, r.Register(context.Background(), &bridge.Service{ID: "redis1", Name: "redis", IP: "10.0.0.3", Port: 6379}))
+
+	assert.Equal(t, hostsFile+`# BEGIN registrator
+10.0.0.3	redis redis1 # id=redis1 port=6379
+# END registrator
+192.168.1.1	router
+`, read(t, path))
+}
+
+func TestServices(t *testing.T) {
+	r, _ := newAdapter(t, hostsFile+`# BEGIN registrator
+10.0.0.2	redis host-redis-6379 master.redis replica.redis # id=host:redis:6379 port=6379
+10.0.0.3	db # id=db1 port=5432 expires=999
+not a service
+# END registrator
+`)
+
+	services, err := r.Services(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, []*bridge.Service{
+		{ID: "host:redis:6379", Name: "redis", IP: "10.0.0.2", Port: 6379, Tags: []string{"master", "replica"}},
+	}, services)
+}
+
+func TestServicesDropsExpiredEntries(t *testing.T) {
+	r, path := newAdapter(t, hostsFile+`# BEGIN registrator
+10.0.0.2	redis # id=redis1 port=6379 expires=1030
+10.0.0.3	db # id=db1 port=5432 expires=999
+# END registrator
+`)
+
+	_, err := r.Services(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, hostsFile+`# BEGIN registrator
+10.0.0.2	redis redis1 # id=redis1 port=6379 expires=1030
+# END registrator
+`, read(t, path))
+}
+
+func TestExpiredEntriesDropped(t *testing.T) {
+	r, path := newAdapter(t, hostsFile)
+	ctx := context.Background()
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "db1", Name: "db", IP: "10.0.0.3", Port: 5432, TTL: 30}))
+
+	r.now = func() time.Time { return time.Unix(1031, 0) }
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "redis1", Name: "redis", IP: "10.0.0.2", Port: 6379}))
+
+	assert.NotContains(t, read(t, path), "db1")
+}
+
+func TestMissingEndMarker(t *testing.T) {
+	r, path := newAdapter(t, hostsFile+"# BEGIN registrator\n")
+
+	err := r.Register(context.Background(), &bridge.Service{ID: "redis1", Name: "redis", IP: "10.0.0.2", Port: 6379})
+
+	assert.True(t, bridge.IsPermanent(err))
+	assert.Equal(t, hostsFile+"# BEGIN registrator\n", read(t, path))
+}
@@ -0,0 +1,51 @@
+// Package atomicfile replaces files that other processes read, for the
+// backends that write files.
+package atomicfile
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// rename is replaced by the tests.
+var rename = os.Rename
+
+// WriteFile replaces the file at path through a temporary file in the same
+// directory, so that readers never see a partial file. The mode of the file
+// is kept, new files get 0644.
+//
+// A file that is bind mounted by itself, such as /etc/hosts in a container,
+// can't be renamed over. It is written in place instead, so readers may see
+// a partial file then.
+func WriteFile(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	err = rename(tmp.Name(), path)
+	if errors.Is(err, syscall.EBUSY) {
+		log.Println("atomicfile: unable to replace", path+", writing it in place:", err)
+		return ioutil.WriteFile(path, data, mode)
+	}
+	return err
+}
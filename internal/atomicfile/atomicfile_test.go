@@ -0,0 +1,60 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out")
+
+	assert.NoError(t, WriteFile(path, []byte("one\n")))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	assert.NoError(t, os.Chmod(path, 0600))
+	assert.NoError(t, WriteFile(path, []byte("two\n")))
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "two\n", string(data))
+	info, _ = os.Stat(path)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
+
+func TestWriteFileInPlaceWhenBusy(t *testing.T) {
+	defer func(saved func(string, string) error) { rename = saved }(rename)
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EBUSY}
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hosts")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("old\n"), 0644))
+
+	assert.NoError(t, WriteFile(path, []byte("new\n")))
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "new\n", string(data))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
+
+func TestWriteFileRenameError(t *testing.T) {
+	defer func(saved func(string, string) error) { rename = saved }(rename)
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	path := filepath.Join(t.TempDir(), "out")
+
+	assert.Error(t, WriteFile(path, []byte("new\n")))
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
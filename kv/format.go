@@ -0,0 +1,260 @@
+// Package kv holds what the key-value backends have in common: how a service
+// is encoded into values and parsed back from them.
+package kv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+)
+
+// Format selects how a service is stored below its key.
+type Format string
+
+const (
+	// FormatAddr stores "<ip>:<port>" at the service key.
+	FormatAddr Format = "addr"
+	// FormatJSON stores a Record as JSON at the service key.
+	FormatJSON Format = "json"
+	// FormatEnv turns the service key into a directory with one key per field.
+	FormatEnv Format = "env"
+)
+
+// ParseFormat reads the format option of a backend URI, e.g.
+// etcd://127.0.0.1:2379/services?format=json. It defaults to FormatAddr.
+func ParseFormat(uri *url.URL) (Format, error) {
+	switch format := Format(uri.Query().Get("format")); format {
+	case "":
+		return FormatAddr, nil
+	case FormatAddr, FormatJSON, FormatEnv:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format %q, must be addr, json or env", format)
+	}
+}
+
+// Check returns an error if services stored in this format at the keys of
+// layout can't be read back. The addr format only stores the address, so
+// the name and ID have to be recovered from the key.
+func (f Format) Check(layout *Layout) error {
+	if f == FormatAddr && !(layout.Captures("Name") && layout.Captures("ID")) {
+		return fmt.Errorf("the addr format needs a key template of plain fields including {{.Name}} and {{.ID}}, use the json or env format")
+	}
+	return nil
+}
+
+// Record is the document stored for a service in the json format.
+type Record struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	IP            string            `json:"ip"`
+	Port          int               `json:"port"`
+	Tags          []string          `json:"tags,omitempty"`
+	Attrs         map[string]string `json:"attrs,omitempty"`
+	Protocol      string            `json:"protocol,omitempty"`
+	Host          string            `json:"host,omitempty"`
+	ContainerID   string            `json:"container_id,omitempty"`
+	ContainerName string            `json:"container_name,omitempty"`
+	Registered    time.Time         `json:"registered"`
+}
+
+// Encode returns the values to store for service, keyed by their path
+// relative to the service key. The addr and json formats store a single
+// value at the service key itself, which has the empty path.
+func (f Format) Encode(service *bridge.Service) (map[string]string, error) {
+	addr := net.JoinHostPort(service.IP, strconv.Itoa(service.Port))
+	switch f {
+	case FormatJSON:
+		record, err := json.Marshal(Record{
+			ID:            service.ID,
+			Name:          service.Name,
+			IP:            service.IP,
+			Port:          service.Port,
+			Tags:          service.Tags,
+			Attrs:         service.Attrs,
+			Protocol:      service.Origin.PortType,
+			Host:          bridge.Hostname,
+			ContainerID:   service.Origin.ContainerID,
+			ContainerName: service.Origin.ContainerName,
+			Registered:    time.Now().UTC(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"": string(record)}, nil
+	case FormatEnv:
+		values := map[string]string{
+			"id":             service.ID,
+			"name":           service.Name,
+			"ip":             service.IP,
+			"port":           strconv.Itoa(service.Port),
+			"addr":           addr,
+			"tags":           strings.Join(service.Tags, ","),
+			"protocol":       service.Origin.PortType,
+			"host":           bridge.Hostname,
+			"container_id":   service.Origin.ContainerID,
+			"container_name": service.Origin.ContainerName,
+			"registered":     time.Now().UTC().Format(time.RFC3339),
+		}
+		for k, v := range service.Attrs {
+			values["attrs/"+k] = v
+		}
+		return values, nil
+	default:
+		return map[string]string{"": addr}, nil
+	}
+}
+
+// Decode rebuilds a service from the values stored below its key, as
+// returned by Encode. The name and ID are those found in the key and are
+// used when the values don't carry them.
+func (f Format) Decode(name, id string, values map[string]string) (*bridge.Service, error) {
+	service := &bridge.Service{ID: id, Name: name}
+	switch f {
+	case FormatJSON:
+		var record Record
+		if err := json.Unmarshal([]byte(values[""]), &record); err != nil {
+			return nil, err
+		}
+		service.IP = record.IP
+		service.Port = record.Port
+		service.Tags = record.Tags
+		service.Attrs = record.Attrs
+		service.Origin.PortType = record.Protocol
+		service.Origin.ContainerID = record.ContainerID
+		service.Origin.ContainerName = record.ContainerName
+		if record.ID != "" {
+			service.ID = record.ID
+		}
+		if record.Name != "" {
+			service.Name = record.Name
+		}
+	case FormatEnv:
+		port, err := strconv.Atoi(values["port"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", values["port"])
+		}
+		service.IP = values["ip"]
+		service.Port = port
+		if tags := values["tags"]; tags != "" {
+			service.Tags = strings.Split(tags, ",")
+		}
+		service.Origin.PortType = values["protocol"]
+		service.Origin.ContainerID = values["container_id"]
+		service.Origin.ContainerName = values["container_name"]
+		for k, v := range values {
+			if strings.HasPrefix(k, "attrs/") {
+				if service.Attrs == nil {
+					service.Attrs = make(map[string]string)
+				}
+				service.Attrs[strings.TrimPrefix(k, "attrs/")] = v
+			}
+		}
+		if values["id"] != "" {
+			service.ID = values["id"]
+		}
+		if values["name"] != "" {
+			service.Name = values["name"]
+		}
+	default:
+		host, port, err := net.SplitHostPort(values[""])
+		if err != nil {
+			return nil, err
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+		service.IP = host
+		service.Port = p
+	}
+	return service, nil
+}
+
+// envFields are the keys stored below a service key in the env format.
+var envFields = map[string]bool{
+	"id": true, "name": true, "ip": true, "port": true, "addr": true, "tags": true,
+	"protocol": true, "host": true, "container_id": true, "container_name": true,
+	"registered": true,
+}
+
+// Parse decodes the services found in values, which are keyed by their full
+// path below prefix. Service keys are matched against layout to recover the
+// fields the value doesn't hold. A service stored at several keys, e.g. one
+// per tag, is returned once. Keys that don't decode are reported through skip.
+func (f Format) Parse(prefix string, layout *Layout, values map[string]string, skip func(key string, err error)) []*bridge.Service {
+	// group the values by the service key they were stored for
+	grouped := make(map[string]map[string]string)
+	for key, value := range values {
+		key = strings.TrimPrefix(strings.TrimPrefix(key, prefix), "/")
+		serviceKey, field := key, ""
+		if f == FormatEnv {
+			parts := strings.Split(key, "/")
+			switch {
+			case len(parts) > 2 && parts[len(parts)-2] == "attrs":
+				serviceKey = strings.Join(parts[:len(parts)-2], "/")
+				field = "attrs/" + parts[len(parts)-1]
+			case len(parts) > 1 && envFields[parts[len(parts)-1]]:
+				serviceKey = strings.Join(parts[:len(parts)-1], "/")
+				field = parts[len(parts)-1]
+			default:
+				continue
+			}
+		}
+		if grouped[serviceKey] == nil {
+			grouped[serviceKey] = make(map[string]string)
+		}
+		grouped[serviceKey][field] = value
+	}
+
+	byServiceID := make(map[string]*bridge.Service)
+	services := make([]*bridge.Service, 0, len(grouped))
+	for key, values := range grouped {
+		fields, ok := layout.Match(key)
+		if !ok && f == FormatAddr {
+			skip(prefix+"/"+key, fmt.Errorf("key doesn't match the key template"))
+			continue
+		}
+		service, err := f.Decode(fields["Name"], fields["ID"], values)
+		if err == nil && (service.Name == "" || service.ID == "") {
+			err = fmt.Errorf("no service name or ID")
+		}
+		if err != nil {
+			skip(prefix+"/"+key, err)
+			continue
+		}
+		if existing := byServiceID[service.ID]; existing != nil {
+			service = existing
+		} else {
+			byServiceID[service.ID] = service
+			services = append(services, service)
+		}
+		if tag := fields["Tag"]; tag != "" && !hasTag(service, tag) {
+			service.Tags = append(service.Tags, tag)
+		}
+	}
+	sort.Sort(byID(services))
+	return services
+}
+
+func hasTag(service *bridge.Service, tag string) bool {
+	for _, t := range service.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type byID []*bridge.Service
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,92 @@
+package kv
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/stretchr/testify/assert"
+)
+
+func testService() *bridge.Service {
+	return &bridge.Service{
+		ID:    "host:web:80",
+		Name:  "web",
+		IP:    "10.0.0.2",
+		Port:  8080,
+		Tags:  []string{"a", "b"},
+		Attrs: map[string]string{"region": "us-east"},
+		Origin: bridge.ServicePort{
+			PortType:      "tcp",
+			ContainerID:   "0123456789ab",
+			ContainerName: "web",
+		},
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for query, format := range map[string]Format{"": FormatAddr, "format=json": FormatJSON, "format=env": FormatEnv} {
+		f, err := ParseFormat(&url.URL{RawQuery: query})
+		assert.NoError(t, err)
+		assert.Equal(t, format, f)
+	}
+	_, err := ParseFormat(&url.URL{RawQuery: "format=xml"})
+	assert.Error(t, err)
+}
+
+func TestCheck(t *testing.T) {
+	for text, valid := range map[string]bool{
+		DefaultLayout:                                true,
+		"{{.Name}}/{{.Tag}}/{{.ID}}":                 true,
+		"{{.Name}}/{{.Host}}/{{.Port}}":              false,
+		"{{.ID}}":                                    false,
+		"{{range .Tags}}{{$.Name}}/{{$.ID}} {{end}}": false,
+	} {
+		layout, _ := NewLayout(text)
+		assert.Equal(t, valid, FormatAddr.Check(layout) == nil, text)
+		assert.NoError(t, FormatJSON.Check(layout), text)
+		assert.NoError(t, FormatEnv.Check(layout), text)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []Format{FormatJSON, FormatEnv} {
+		values, err := format.Encode(testService())
+		assert.NoError(t, err)
+
+		service, err := format.Decode("web", "host:web:80", values)
+		assert.NoError(t, err)
+		assert.Equal(t, testService(), service, string(format))
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	values := map[string]string{
+		"/services/web/host:web:80":   "10.0.0.2:8080",
+		"/services/web/host:web:8080": "[2001:db8::1]:8080",
+		"/services/web/broken":        "nope",
+	}
+	var skipped []string
+	layout, _ := NewLayout(DefaultLayout)
+	services := FormatAddr.Parse("/services", layout, values, func(key string, err error) {
+		skipped = append(skipped, key)
+	})
+	assert.Equal(t, []string{"/services/web/broken"}, skipped)
+	assert.Len(t, services, 2)
+	assert.Equal(t, &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.2", Port: 8080}, services[0])
+	assert.Equal(t, "2001:db8::1", services[1].IP)
+}
+
+func TestParseEnv(t *testing.T) {
+	encoded, err := FormatEnv.Encode(testService())
+	assert.NoError(t, err)
+	values := make(map[string]string)
+	for k, v := range encoded {
+		values["services/web/host:web:80/"+k] = v
+	}
+	layout, _ := NewLayout(DefaultLayout)
+	services := FormatEnv.Parse("services", layout, values, func(key string, err error) {
+		t.Error(key, err)
+	})
+	assert.Equal(t, []*bridge.Service{testService()}, services)
+}
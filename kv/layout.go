@@ -0,0 +1,156 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/42wim/registrator-work/bridge"
+)
+
+// DefaultLayout is the key template used when a backend URI has no key option.
+const DefaultLayout = "{{.Name}}/{{.ID}}"
+
+// Layout maps a service to the keys it is stored at, relative to the prefix
+// of the backend. It is a text/template executed with KeyData. A template
+// referring to .Tag is rendered once per tag of the service, and its output
+// is split on whitespace, so one service may map to several keys.
+type Layout struct {
+	tmpl *template.Template
+
+	// pattern matches the keys rendered by tmpl, capturing the fields used
+	// in it. It is nil if the template is too complex to be reversed.
+	pattern *regexp.Regexp
+}
+
+// KeyData is what a key template is executed with.
+type KeyData struct {
+	*bridge.Service
+	Tag  string // one of the service's tags, empty if it has none
+	Host string // hostname of the registrator host
+}
+
+// ParseLayout reads the key option of a backend URI, e.g.
+// consulkv://127.0.0.1:8500/services?format=json&key={{.Name}}/{{.Host}}/{{.Port}}
+func ParseLayout(uri *url.URL) (*Layout, error) {
+	text := uri.Query().Get("key")
+	if text == "" {
+		text = DefaultLayout
+	}
+	return NewLayout(text)
+}
+
+// NewLayout parses a key template.
+func NewLayout(text string) (*Layout, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key template: %v", err)
+	}
+	return &Layout{tmpl: tmpl, pattern: keyPattern(tmpl.Tree.Root)}, nil
+}
+
+// Keys renders the keys of service. They are cleaned and never empty.
+func (l *Layout) Keys(service *bridge.Service) ([]string, error) {
+	tags := service.Tags
+	if len(tags) == 0 {
+		tags = []string{""}
+	}
+	seen := make(map[string]bool)
+	keys := make([]string, 0, 1)
+	for _, tag := range tags {
+		var out bytes.Buffer
+		err := l.tmpl.Execute(&out, KeyData{Service: service, Tag: tag, Host: bridge.Hostname})
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range strings.Fields(out.String()) {
+			key = strings.Trim(path.Clean("/"+key), "/")
+			if key != "" && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("key template rendered no key for %s", service.ID)
+	}
+	return keys, nil
+}
+
+// Captures reports whether Match recovers field from the keys of the layout.
+func (l *Layout) Captures(field string) bool {
+	if l.pattern == nil {
+		return false
+	}
+	for _, name := range l.pattern.SubexpNames() {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reverses a key rendered by the layout into the fields used in the
+// template, e.g. "Name" and "ID" for the default layout.
+func (l *Layout) Match(key string) (map[string]string, bool) {
+	if l.pattern == nil {
+		return nil, false
+	}
+	matches := l.pattern.FindStringSubmatch(key)
+	if matches == nil {
+		return nil, false
+	}
+	fields := make(map[string]string)
+	for i, name := range l.pattern.SubexpNames() {
+		if name != "" && fields[name] == "" {
+			fields[name] = matches[i]
+		}
+	}
+	return fields, true
+}
+
+// keyPattern turns a template made of text and plain {{.Field}} actions into
+// a regexp capturing those fields. It returns nil for anything else.
+func keyPattern(root *parse.ListNode) *regexp.Regexp {
+	var pattern bytes.Buffer
+	pattern.WriteString("^")
+	optional := false
+	for i, node := range root.Nodes {
+		switch node := node.(type) {
+		case *parse.TextNode:
+			text := string(node.Text)
+			if optional {
+				text = text[1:]
+				optional = false
+			}
+			pattern.WriteString(regexp.QuoteMeta(text))
+		case *parse.ActionNode:
+			if len(node.Pipe.Decl) != 0 || len(node.Pipe.Cmds) != 1 || len(node.Pipe.Cmds[0].Args) != 1 {
+				return nil
+			}
+			field, ok := node.Pipe.Cmds[0].Args[0].(*parse.FieldNode)
+			if !ok || len(field.Ident) != 1 {
+				return nil
+			}
+			switch name := field.Ident[0]; {
+			case name == "Tag" && i+1 < len(root.Nodes) && strings.HasPrefix(root.Nodes[i+1].String(), "/"):
+				// a service without tags has no directory for them
+				pattern.WriteString("(?:(?P<Tag>[^/]+)/)?")
+				optional = true
+			case name == "Port" || name == "TTL":
+				pattern.WriteString("(?P<" + name + ">[0-9]+)")
+			default:
+				pattern.WriteString("(?P<" + name + ">[^/]+)")
+			}
+		default:
+			return nil
+		}
+	}
+	pattern.WriteString("$")
+	return regexp.MustCompile(pattern.String())
+}
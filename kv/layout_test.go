@@ -0,0 +1,67 @@
+package kv
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLayout(t *testing.T) {
+	layout, err := ParseLayout(&url.URL{})
+	assert.NoError(t, err)
+	keys, err := layout.Keys(testService())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"web/host:web:80"}, keys)
+
+	_, err = ParseLayout(&url.URL{RawQuery: "key=" + url.QueryEscape("{{.Name")})
+	assert.Error(t, err)
+}
+
+func TestLayoutKeys(t *testing.T) {
+	bridge.Hostname = "docker1"
+	for text, expected := range map[string][]string{
+		"{{.Name}}/{{.Host}}/{{.Port}}":                      {"web/docker1/8080"},
+		"{{.Name}}/{{.Tag}}/{{.ID}}":                         {"web/a/host:web:80", "web/b/host:web:80"},
+		"{{range .Tags}}{{$.Name}}/{{.}}/{{$.IP}} {{end}}":   {"web/a/10.0.0.2", "web/b/10.0.0.2"},
+		"/{{.Name}}//{{index .Attrs \"region\"}}/{{.Port}}/": {"web/us-east/8080"},
+	} {
+		layout, err := NewLayout(text)
+		assert.NoError(t, err)
+		keys, err := layout.Keys(testService())
+		assert.NoError(t, err)
+		assert.Equal(t, expected, keys, text)
+	}
+}
+
+func TestLayoutMatch(t *testing.T) {
+	layout, _ := NewLayout("{{.Name}}/{{.IP}}:{{.Port}}")
+	fields, ok := layout.Match("web/2001:db8::1:8080")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"Name": "web", "IP": "2001:db8::1", "Port": "8080"}, fields)
+
+	_, ok = layout.Match("web/extra/10.0.0.2:8080")
+	assert.False(t, ok)
+
+	layout, _ = NewLayout("{{range .Tags}}{{.}}{{end}}")
+	_, ok = layout.Match("a")
+	assert.False(t, ok)
+}
+
+func TestParseTaggedLayout(t *testing.T) {
+	layout, _ := NewLayout("{{.Name}}/{{.Tag}}/{{.ID}}")
+	values := map[string]string{
+		"services/web/a/host:web:80": "10.0.0.2:8080",
+		"services/web/b/host:web:80": "10.0.0.2:8080",
+		"services/db/host:db:5432":   "10.0.0.3:5432",
+	}
+	services := FormatAddr.Parse("services", layout, values, func(key string, err error) {
+		t.Error(key, err)
+	})
+	assert.Len(t, services, 2)
+	assert.Equal(t, "host:db:5432", services[0].ID)
+	assert.Empty(t, services[0].Tags)
+	assert.Equal(t, "host:web:80", services[1].ID)
+	assert.ElementsMatch(t, []string{"a", "b"}, services[1].Tags)
+}
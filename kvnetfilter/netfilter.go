@@ -1,6 +1,9 @@
 package kvnetfilter
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/42wim/registrator-work/bridge"
 	consulapi "github.com/hashicorp/consul/api"
 	"log"
@@ -17,7 +20,7 @@ func init() {
 
 type Factory struct{}
 
-func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
 	// init consul
 	config := consulapi.DefaultConfig()
 	if uri.Host != "" {
@@ -25,29 +28,20 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	}
 	client, err := consulapi.NewClient(config)
 	if err != nil {
-		log.Fatal("consulkv: ", uri.Scheme)
+		return nil, fmt.Errorf("kvnetfilter: %v", err)
 	}
 
 	params := strings.Split(uri.Path, "/")
 	if len(params) != 5 {
-		log.Fatal("no correct scheme", len(params), params)
+		return nil, errors.New("kvnetfilter: path required e.g.: kvnetfilter://<host>/<kvpath>/<aclpath>/<chain>/<set>")
 	}
 
 	kvpath := params[1]
 	aclpath := params[2]
-	// init netfilter
 	chain := params[3]
 	set := params[4]
 
-	FirewalldInit()
-	if firewalldRunning {
-		OnReloaded(func() { iptablesInit(chain, set) })
-	}
-	ipsetInit(set)
-	iptablesInit(chain, set)
-
-	return &NetfilterAdapter{Chain: chain, Set: set, client: client, path: kvpath, aclpath: aclpath}
-
+	return &NetfilterAdapter{Chain: chain, Set: set, client: client, path: kvpath, aclpath: aclpath}, nil
 }
 
 type NetfilterAdapter struct {
@@ -56,32 +50,56 @@ type NetfilterAdapter struct {
 	client  *consulapi.Client
 	path    string
 	aclpath string
+
+	firewalld   bool
+	initialized bool
 }
 
-func (r *NetfilterAdapter) Ping() error {
+// Ping sets up firewalld, the ipset and the iptables rules, until it succeeds.
+func (r *NetfilterAdapter) Ping(ctx context.Context) error {
+	if r.initialized {
+		return nil
+	}
+	if !r.firewalld {
+		if err := FirewalldInit(); err != nil {
+			log.Println("kvnetfilter: firewalld not used:", err)
+		}
+		if firewalldRunning {
+			chain, set := r.Chain, r.Set
+			OnReloaded(func() { iptablesInit(chain, set) })
+		}
+		r.firewalld = true
+	}
+	if err := ipsetInit(r.Set); err != nil {
+		return err
+	}
+	if err := iptablesInit(r.Chain, r.Set); err != nil {
+		return err
+	}
+	r.initialized = true
 	return nil
 }
 
-func (r *NetfilterAdapter) Register(service *bridge.Service) error {
+func (r *NetfilterAdapter) Register(ctx context.Context, service *bridge.Service) error {
 	if strings.Contains(service.IP, ":") {
 		for k, _ := range service.Tags {
 			service.Tags[k] = path.Clean(service.Tags[k])
 		}
-		err := r.kvRegister(service)
+		err := r.kvRegister(ctx, service)
 		if err != nil {
 			return err
 		}
 		var srcRanges []string
 		// traverse every tag
 		for _, tag := range service.Tags {
-			srcRanges = append(srcRanges, r.kvFindACL(service.Name+"/"+tag+"/")...)
+			srcRanges = append(srcRanges, r.kvFindACL(ctx, service.Name+"/"+tag+"/")...)
 		}
 		// service too
-		srcRanges = append(srcRanges, r.kvFindACL(service.Name+"/_all/")...)
+		srcRanges = append(srcRanges, r.kvFindACL(ctx, service.Name+"/_all/")...)
 
 		// no results, use fallback
 		if len(srcRanges) == 0 {
-			srcRanges = append(srcRanges, r.kvFindACL("/_fallback/")...)
+			srcRanges = append(srcRanges, r.kvFindACL(ctx, "/_fallback/")...)
 		}
 
 		if len(srcRanges) > 0 {
@@ -106,19 +124,19 @@ func (r *NetfilterAdapter) Register(service *bridge.Service) error {
 	return nil
 }
 
-func (r *NetfilterAdapter) Deregister(service *bridge.Service) error {
+func (r *NetfilterAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
 	if strings.Contains(service.IP, ":") {
 		var srcRanges []string
 		// traverse every tag
 		for _, tag := range service.Tags {
-			srcRanges = append(srcRanges, r.kvFindACL(service.Name+"/"+tag+"/")...)
+			srcRanges = append(srcRanges, r.kvFindACL(ctx, service.Name+"/"+tag+"/")...)
 		}
 		// service too
-		srcRanges = append(srcRanges, r.kvFindACL(service.Name+"/_all/")...)
+		srcRanges = append(srcRanges, r.kvFindACL(ctx, service.Name+"/_all/")...)
 
 		// no results, use fallback
 		if len(srcRanges) == 0 {
-			srcRanges = append(srcRanges, r.kvFindACL("/_fallback/")...)
+			srcRanges = append(srcRanges, r.kvFindACL(ctx, "/_fallback/")...)
 		}
 
 		if len(srcRanges) > 0 {
@@ -134,7 +152,7 @@ func (r *NetfilterAdapter) Deregister(service *bridge.Service) error {
 			}
 		}
 		// deregister after netfilter removal
-		err := r.kvDeregister(service)
+		err := r.kvDeregister(ctx, service)
 		if err != nil {
 			return err
 		}
@@ -142,17 +160,18 @@ func (r *NetfilterAdapter) Deregister(service *bridge.Service) error {
 	return nil
 }
 
-func (r *NetfilterAdapter) Refresh(service *bridge.Service) error {
-	return r.Register(service)
+func (r *NetfilterAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	return r.Register(ctx, service)
 }
 
-func (r *NetfilterAdapter) kvRegister(service *bridge.Service) error {
+func (r *NetfilterAdapter) kvRegister(ctx context.Context, service *bridge.Service) error {
 	var path string
 	var err error
+	opts := (&consulapi.WriteOptions{}).WithContext(ctx)
 	// only register in /service.Name when tags are empty
 	if len(service.Tags) == 0 {
 		path = r.path + "/" + service.Name + "/" + service.ID
-		_, err = r.client.KV().Put(&consulapi.KVPair{Key: path, Value: []byte(service.IP + "#" + strconv.Itoa(int(time.Now().Unix())))}, nil)
+		_, err = r.client.KV().Put(&consulapi.KVPair{Key: path, Value: []byte(service.IP + "#" + strconv.Itoa(int(time.Now().Unix())))}, opts)
 		if err != nil {
 			log.Println("consulkv: failed to register service:", err)
 		}
@@ -161,7 +180,7 @@ func (r *NetfilterAdapter) kvRegister(service *bridge.Service) error {
 
 	for _, tag := range service.Tags {
 		path = r.path + "/" + service.Name + "/" + tag + "/" + service.ID
-		_, err = r.client.KV().Put(&consulapi.KVPair{Key: path, Value: []byte(service.IP + "#" + strconv.Itoa(int(time.Now().Unix())))}, nil)
+		_, err = r.client.KV().Put(&consulapi.KVPair{Key: path, Value: []byte(service.IP + "#" + strconv.Itoa(int(time.Now().Unix())))}, opts)
 		if err != nil {
 			log.Println("consulkv: failed to register service:", err)
 		}
@@ -169,12 +188,13 @@ func (r *NetfilterAdapter) kvRegister(service *bridge.Service) error {
 	return err
 }
 
-func (r *NetfilterAdapter) kvDeregister(service *bridge.Service) error {
+func (r *NetfilterAdapter) kvDeregister(ctx context.Context, service *bridge.Service) error {
 	var path string
 	var err error
+	opts := (&consulapi.WriteOptions{}).WithContext(ctx)
 	if len(service.Tags) == 0 {
 		path = r.path + "/" + service.Name + "/" + service.ID
-		_, err = r.client.KV().Delete(path, nil)
+		_, err = r.client.KV().Delete(path, opts)
 		if err != nil {
 			log.Println("consulkv: failed to deregister service:", err)
 		}
@@ -183,7 +203,7 @@ func (r *NetfilterAdapter) kvDeregister(service *bridge.Service) error {
 
 	for _, tag := range service.Tags {
 		path = r.path + "/" + service.Name + "/" + tag + "/" + service.ID
-		_, err = r.client.KV().Delete(path, nil)
+		_, err = r.client.KV().Delete(path, opts)
 		if err != nil {
 			log.Println("consulkv: failed to deregister service:", err)
 		}
@@ -191,11 +211,12 @@ func (r *NetfilterAdapter) kvDeregister(service *bridge.Service) error {
 	return err
 }
 
-func (r *NetfilterAdapter) kvFindACL(key string) []string {
+func (r *NetfilterAdapter) kvFindACL(ctx context.Context, key string) []string {
 	var acls []string
+	opts := (&consulapi.QueryOptions{}).WithContext(ctx)
 	url := "/" + r.aclpath + "/" + key
 	log.Println("looking for ACL in ", url)
-	kps, _, _ := r.client.KV().List(url, nil)
+	kps, _, _ := r.client.KV().List(url, opts)
 	for _, kp := range kps {
 		if len(kp.Value) > 0 {
 			log.Println("keys to search ", string(kp.Value))
@@ -204,7 +225,7 @@ func (r *NetfilterAdapter) kvFindACL(key string) []string {
 				acls = append(acls, string(kp.Value))
 				continue
 			}
-			rkps, _, _ := r.client.KV().List(string(kp.Value), nil)
+			rkps, _, _ := r.client.KV().List(string(kp.Value), opts)
 			for _, rkp := range rkps {
 				log.Print("found acl: ", string(rkp.Value))
 				acls = append(acls, string(rkp.Value))
@@ -213,7 +234,3 @@ func (r *NetfilterAdapter) kvFindACL(key string) []string {
 	}
 	return acls
 }
-
-func (r *NetfilterAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
-}
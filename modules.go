@@ -3,8 +3,17 @@ package main
 import (
 	_ "github.com/42wim/registrator-work/consul"
 	_ "github.com/42wim/registrator-work/consulkv"
+	_ "github.com/42wim/registrator-work/coredns"
+	_ "github.com/42wim/registrator-work/dns"
 	_ "github.com/42wim/registrator-work/etcd"
+	_ "github.com/42wim/registrator-work/etcd3"
+	_ "github.com/42wim/registrator-work/eureka"
+	_ "github.com/42wim/registrator-work/filesd"
+	_ "github.com/42wim/registrator-work/hosts"
 	_ "github.com/42wim/registrator-work/kvnetfilter"
 	_ "github.com/42wim/registrator-work/netfilter"
+	_ "github.com/42wim/registrator-work/redis"
 	_ "github.com/42wim/registrator-work/skydns2"
+	_ "github.com/42wim/registrator-work/template"
+	_ "github.com/42wim/registrator-work/webhook"
 )
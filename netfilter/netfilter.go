@@ -1,7 +1,10 @@
 package netfilter
 
 import (
+	"context"
+	"errors"
 	"github.com/42wim/registrator-work/bridge"
+	"log"
 	"net/url"
 	"strconv"
 	"strings"
@@ -13,7 +16,7 @@ func init() {
 
 type Factory struct{}
 
-func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
 	var chain, set string
 	if uri.Host != "" {
 		chain = uri.Host
@@ -22,24 +25,45 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 		chain = "FORWARD_direct"
 		set = "containerports"
 	}
-	ipsetInit(set)
-
-	if chain != "-" {
-		FirewalldInit()
-		if firewalldRunning {
-			OnReloaded(func() { iptablesInit(chain, set) })
-		}
-		iptablesInit(chain, set)
+	if set == "" {
+		return nil, errors.New("netfilter: set required e.g.: netfilter://<chain>/<set>")
 	}
-	return &NetfilterAdapter{Chain: chain, Set: set}
+	return &NetfilterAdapter{Chain: chain, Set: set}, nil
 }
 
 type NetfilterAdapter struct {
 	Chain string
 	Set   string
+
+	firewalld   bool
+	initialized bool
 }
 
-func (r *NetfilterAdapter) Ping() error {
+// Ping sets up the ipset and, unless the chain is "-", firewalld and the
+// iptables rules, until it succeeds.
+func (r *NetfilterAdapter) Ping(ctx context.Context) error {
+	if r.initialized {
+		return nil
+	}
+	if err := ipsetInit(r.Set); err != nil {
+		return err
+	}
+	if r.Chain != "-" {
+		if !r.firewalld {
+			if err := FirewalldInit(); err != nil {
+				log.Println("netfilter: firewalld not used:", err)
+			}
+			if firewalldRunning {
+				chain, set := r.Chain, r.Set
+				OnReloaded(func() { iptablesInit(chain, set) })
+			}
+			r.firewalld = true
+		}
+		if err := iptablesInit(r.Chain, r.Set); err != nil {
+			return err
+		}
+	}
+	r.initialized = true
 	return nil
 }
 
@@ -67,9 +91,15 @@ func (r *NetfilterAdapter) SetsForHost(service *bridge.Service) []string {
 	return sets
 }
 
-func (r *NetfilterAdapter) Register(service *bridge.Service) error {
+// Register and Deregister run one ipset command per set, and stop between
+// them once ctx is done.
+
+func (r *NetfilterAdapter) Register(ctx context.Context, service *bridge.Service) error {
 	if strings.Contains(service.IP, ":") {
 		for _, set := range r.SetsForHost(service) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			err := ipsetHost("add", set, service.IP, service.Origin.PortType, strconv.Itoa(service.Port), strconv.Itoa(service.TTL))
 			if err != nil {
 				return err
@@ -79,9 +109,12 @@ func (r *NetfilterAdapter) Register(service *bridge.Service) error {
 	return nil
 }
 
-func (r *NetfilterAdapter) Deregister(service *bridge.Service) error {
+func (r *NetfilterAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
 	if strings.Contains(service.IP, ":") {
 		for _, set := range r.SetsForHost(service) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			err := ipsetHost("del", set, service.IP, service.Origin.PortType, strconv.Itoa(service.Port), "")
 			if err != nil {
 				return err
@@ -91,10 +124,6 @@ func (r *NetfilterAdapter) Deregister(service *bridge.Service) error {
 	return nil
 }
 
-func (r *NetfilterAdapter) Refresh(service *bridge.Service) error {
-	return r.Register(service)
-}
-
-func (r *NetfilterAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+func (r *NetfilterAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	return r.Register(ctx, service)
 }
@@ -0,0 +1,303 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// DefaultPrefix is the prefix of the keys unless configured otherwise.
+const DefaultPrefix = "registrator"
+
+func init() {
+	f := new(Factory)
+	bridge.Register(f, "redis")
+	bridge.Register(f, "rediss")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
+	// take out the options of the adapter, the rest of the URI is handed
+	// to the client
+	client := *uri
+	query := uri.Query()
+	prefix := DefaultPrefix
+	if value := query.Get("prefix"); value != "" {
+		prefix = value
+	}
+	channel := prefix + ":events"
+	if value := query.Get("channel"); value != "" {
+		channel = value
+	}
+	query.Del("prefix")
+	query.Del("channel")
+	client.RawQuery = query.Encode()
+	if client.Host == "" {
+		client.Host = "127.0.0.1:6379"
+	}
+
+	opts, err := goredis.ParseURL(client.String())
+	if err != nil {
+		return nil, fmt.Errorf("redis: %v", err)
+	}
+	return &RedisAdapter{
+		client:  goredis.NewClient(opts),
+		prefix:  prefix,
+		channel: channel,
+		now:     time.Now,
+	}, nil
+}
+
+// RedisAdapter stores every service as a hash and keeps a sorted set of the
+// IDs of the services of each name:
+//
+//	<prefix>:service:<id>   hash of id, name, ip, port, tags and attrs
+//	<prefix>:name:<name>    sorted set of service IDs, scored by the Unix
+//	                        time they expire at, +inf without a TTL
+//
+// Expired IDs are removed from the set whenever a service of the name is
+// registered, refreshed or deregistered, and the set expires with its
+// newest ID, so that it doesn't outlive the services of the name.
+// Registrations and deregistrations are published as an Event on a channel.
+type RedisAdapter struct {
+	client  *goredis.Client
+	prefix  string
+	channel string
+	now     func() time.Time
+}
+
+// Event is the message published for a registration or deregistration.
+type Event struct {
+	Event string            `json:"event"` // register or deregister
+	ID    string            `json:"id"`
+	Name  string            `json:"name"`
+	IP    string            `json:"ip"`
+	Port  int               `json:"port"`
+	Tags  []string          `json:"tags,omitempty"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+func (r *RedisAdapter) Ping(ctx context.Context) error {
+	return classify(r.client.Ping(ctx).Err())
+}
+
+// Register writes the service and adds it to the set of its name, in one
+// transaction. With a TTL, the service expires unless refreshed.
+func (r *RedisAdapter) Register(ctx context.Context, service *bridge.Service) error {
+	attrs, err := json.Marshal(service.Attrs)
+	if err != nil {
+		return bridge.Permanent(err)
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		key := r.serviceKey(service.ID)
+		pipe.HSet(ctx, key,
+			"id", service.ID,
+			"name", service.Name,
+			"ip", service.IP,
+			"port", service.Port,
+			"tags", strings.Join(service.Tags, ","),
+			"attrs", string(attrs))
+		if service.TTL > 0 {
+			pipe.Expire(ctx, key, time.Duration(service.TTL)*time.Second)
+		} else {
+			pipe.Persist(ctx, key)
+		}
+		r.index(ctx, pipe, service)
+		return nil
+	})
+	if err != nil {
+		log.Println("redis: failed to register service:", err)
+		return classify(err)
+	}
+	r.publish(ctx, "register", service)
+	return nil
+}
+
+func (r *RedisAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Del(ctx, r.serviceKey(service.ID))
+		pipe.ZRem(ctx, r.nameKey(service.Name), service.ID)
+		r.prune(ctx, pipe, service.Name)
+		return nil
+	})
+	if err != nil {
+		log.Println("redis: failed to deregister service:", err)
+		return classify(err)
+	}
+	r.publish(ctx, "deregister", service)
+	return nil
+}
+
+// Refresh extends the expiry of the service and of its ID in the set of its
+// name. If the service expired in the meantime, it is written again.
+func (r *RedisAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	if service.TTL == 0 {
+		return nil
+	}
+	var found *goredis.BoolCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		found = pipe.Expire(ctx, r.serviceKey(service.ID), time.Duration(service.TTL)*time.Second)
+		r.index(ctx, pipe, service)
+		return nil
+	})
+	if err != nil {
+		log.Println("redis: failed to refresh service:", err)
+		return classify(err)
+	}
+	if !found.Val() {
+		log.Println("redis: service expired, registering again:", service.ID)
+		return r.Register(ctx, service)
+	}
+	return nil
+}
+
+// Services scans the keys of the services and reads them.
+func (r *RedisAdapter) Services(ctx context.Context) ([]*bridge.Service, error) {
+	pattern := r.serviceKey("*")
+	var keys []string
+	iter := r.client.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return []*bridge.Service{}, classify(err)
+	}
+
+	cmds := make([]*goredis.MapStringStringCmd, len(keys))
+	_, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HGetAll(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return []*bridge.Service{}, classify(err)
+	}
+
+	services := make([]*bridge.Service, 0, len(keys))
+	for i, cmd := range cmds {
+		// expired or deleted since the scan
+		if len(cmd.Val()) == 0 {
+			continue
+		}
+		service, err := parseService(cmd.Val())
+		if err != nil {
+			log.Println("redis: skipping", keys[i]+":", err)
+			continue
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// expireScript makes a set of IDs expire at the score of its newest ID, or
+// never if an ID has no TTL. An empty set is gone already.
+var expireScript = goredis.NewScript(`
+if redis.call('ZCOUNT', KEYS[1], '+inf', '+inf') > 0 then
+	redis.call('PERSIST', KEYS[1])
+else
+	local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+	if newest[2] then
+		redis.call('EXPIREAT', KEYS[1], newest[2])
+	end
+end
+return 0
+`)
+
+// index queues adding the ID of service to the set of its name, scored by
+// when it expires, and pruning the set.
+func (r *RedisAdapter) index(ctx context.Context, pipe goredis.Pipeliner, service *bridge.Service) {
+	expires := math.Inf(1)
+	if service.TTL > 0 {
+		expires = float64(r.now().Add(time.Duration(service.TTL) * time.Second).Unix())
+	}
+	pipe.ZAdd(ctx, r.nameKey(service.Name), goredis.Z{Score: expires, Member: service.ID})
+	r.prune(ctx, pipe, service.Name)
+}
+
+// prune queues removing the IDs that expired before now from the set of
+// name, and setting the expiry of the set. The script runs in the
+// transaction, as the expiry depends on the scores in the set.
+func (r *RedisAdapter) prune(ctx context.Context, pipe goredis.Pipeliner, name string) {
+	key := r.nameKey(name)
+	pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(r.now().Unix(), 10))
+	expireScript.Eval(ctx, pipe, []string{key})
+}
+
+// publish announces an event about service. Subscribers may miss events
+// anyway, so failing to publish doesn't fail the operation.
+func (r *RedisAdapter) publish(ctx context.Context, event string, service *bridge.Service) {
+	message, err := json.Marshal(&Event{
+		Event: event,
+		ID:    service.ID,
+		Name:  service.Name,
+		IP:    service.IP,
+		Port:  service.Port,
+		Tags:  service.Tags,
+		Attrs: service.Attrs,
+	})
+	if err == nil {
+		err = r.client.Publish(ctx, r.channel, message).Err()
+	}
+	if err != nil {
+		log.Println("redis: failed to publish", event, "of", service.ID+":", err)
+	}
+}
+
+func (r *RedisAdapter) serviceKey(id string) string {
+	return r.prefix + ":service:" + id
+}
+
+func (r *RedisAdapter) nameKey(name string) string {
+	return r.prefix + ":name:" + name
+}
+
+func parseService(fields map[string]string) (*bridge.Service, error) {
+	port, err := strconv.Atoi(fields["port"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", fields["port"])
+	}
+	service := &bridge.Service{
+		ID:   fields["id"],
+		Name: fields["name"],
+		IP:   fields["ip"],
+		Port: port,
+	}
+	if service.ID == "" || service.Name == "" {
+		return nil, errors.New("missing id or name")
+	}
+	if fields["tags"] != "" {
+		service.Tags = strings.Split(fields["tags"], ",")
+	}
+	if attrs := fields["attrs"]; attrs != "" && attrs != "null" {
+		if err := json.Unmarshal([]byte(attrs), &service.Attrs); err != nil {
+			return nil, fmt.Errorf("invalid attrs: %v", err)
+		}
+	}
+	return service, nil
+}
+
+// classify marks the errors retrying can't fix as permanent: keys of the
+// wrong type and missing permissions.
+func classify(err error) error {
+	var reply goredis.Error
+	if errors.As(err, &reply) {
+		for _, prefix := range []string{"WRONGTYPE", "NOPERM", "NOAUTH", "WRONGPASS"} {
+			if strings.HasPrefix(reply.Error(), prefix) {
+				return bridge.Permanent(err)
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,192 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// newAdapter returns an adapter connected to an in-process Redis.
+func newAdapter(t *testing.T, query string) (*RedisAdapter, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	adapter, err := new(Factory).New(&url.URL{Scheme: "redis", Host: server.Addr(), RawQuery: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := adapter.(*RedisAdapter)
+	t.Cleanup(func() { r.client.Close() })
+	assert.NoError(t, r.Ping(context.Background()))
+	return r, server
+}
+
+var service = &bridge.Service{
+	ID:    "host:redis:6379",
+	Name:  "redis",
+	IP:    "10.0.0.2",
+	Port:  6379,
+	Tags:  []string{"master", "cache"},
+	Attrs: map[string]string{"region": "us-east"},
+}
+
+func TestFactory(t *testing.T) {
+	adapter, err := new(Factory).New(&url.URL{Scheme: "rediss", Host: "example.com:6380", Path: "/2", RawQuery: "prefix=apps&channel=changes"})
+
+	assert.NoError(t, err)
+	r := adapter.(*RedisAdapter)
+	assert.Equal(t, "example.com:6380", r.client.Options().Addr)
+	assert.Equal(t, 2, r.client.Options().DB)
+	assert.NotNil(t, r.client.Options().TLSConfig)
+	assert.Equal(t, "apps", r.prefix)
+	assert.Equal(t, "changes", r.channel)
+
+	_, err = new(Factory).New(&url.URL{Scheme: "redis", Host: "example.com", Path: "/db"})
+	assert.Error(t, err)
+}
+
+func TestRegister(t *testing.T) {
+	r, server := newAdapter(t, "")
+	ctx := context.Background()
+
+	assert.NoError(t, r.Register(ctx, service))
+
+	key := "registrator:service:host:redis:6379"
+	assert.Equal(t, "10.0.0.2", server.HGet(key, "ip"))
+	assert.Equal(t, "6379", server.HGet(key, "port"))
+	assert.Equal(t, "master,cache", server.HGet(key, "tags"))
+	assert.Equal(t, `{"region":"us-east"}`, server.HGet(key, "attrs"))
+	members, _ := server.ZMembers("registrator:name:redis")
+	assert.Equal(t, []string{"host:redis:6379"}, members)
+	score, _ := server.ZScore("registrator:name:redis", "host:redis:6379")
+	assert.True(t, math.IsInf(score, 1))
+	assert.Equal(t, time.Duration(0), server.TTL(key))
+
+	assert.NoError(t, r.Deregister(ctx, service))
+
+	assert.False(t, server.Exists(key))
+	assert.False(t, server.Exists("registrator:name:redis"))
+}
+
+func TestExpiry(t *testing.T) {
+	r, server := newAdapter(t, "prefix=apps")
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	server.SetTime(now)
+	forward := func(d time.Duration) {
+		now = now.Add(d)
+		server.SetTime(now)
+		server.FastForward(d)
+	}
+	ttl := *service
+	ttl.TTL = 30
+
+	assert.NoError(t, r.Register(ctx, &ttl))
+	assert.Equal(t, 30*time.Second, server.TTL("apps:service:host:redis:6379"))
+	assert.Equal(t, 30*time.Second, server.TTL("apps:name:redis"))
+	score, _ := server.ZScore("apps:name:redis", "host:redis:6379")
+	assert.Equal(t, float64(1030), score)
+
+	forward(20 * time.Second)
+	assert.NoError(t, r.Refresh(ctx, &ttl))
+	assert.Equal(t, 30*time.Second, server.TTL("apps:service:host:redis:6379"))
+	score, _ = server.ZScore("apps:name:redis", "host:redis:6379")
+	assert.Equal(t, float64(1050), score)
+	assert.Equal(t, 30*time.Second, server.TTL("apps:name:redis"))
+
+	forward(31 * time.Second)
+	assert.False(t, server.Exists("apps:service:host:redis:6379"))
+	assert.False(t, server.Exists("apps:name:redis"))
+
+	// expired in the meantime
+	assert.NoError(t, r.Refresh(ctx, &ttl))
+	assert.True(t, server.Exists("apps:service:host:redis:6379"))
+}
+
+func TestSharedName(t *testing.T) {
+	r, server := newAdapter(t, "")
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	server.SetTime(now)
+	short := &bridge.Service{ID: "short", Name: "web", IP: "10.0.0.2", Port: 80, TTL: 10}
+	long := &bridge.Service{ID: "long", Name: "web", IP: "10.0.0.3", Port: 80, TTL: 60}
+	forever := &bridge.Service{ID: "forever", Name: "web", IP: "10.0.0.4", Port: 80}
+
+	assert.NoError(t, r.Register(ctx, short))
+	assert.NoError(t, r.Register(ctx, long))
+	assert.NoError(t, r.Register(ctx, forever))
+
+	// the registration without a TTL doesn't keep the others alive
+	assert.Equal(t, 10*time.Second, server.TTL("registrator:service:short"))
+
+	// nor the set of their name
+	assert.Equal(t, time.Duration(0), server.TTL("registrator:name:web"))
+
+	// the expired ID is removed when another one is refreshed
+	now = now.Add(20 * time.Second)
+	server.SetTime(now)
+	server.FastForward(20 * time.Second)
+	assert.NoError(t, r.Refresh(ctx, long))
+	members, _ := server.ZMembers("registrator:name:web")
+	assert.ElementsMatch(t, []string{"long", "forever"}, members)
+
+	// the set expires with the newest ID once the one without a TTL is gone
+	assert.NoError(t, r.Deregister(ctx, forever))
+	assert.Equal(t, 60*time.Second, server.TTL("registrator:name:web"))
+	now = now.Add(61 * time.Second)
+	server.SetTime(now)
+	server.FastForward(61 * time.Second)
+	assert.False(t, server.Exists("registrator:name:web"))
+}
+
+func TestServices(t *testing.T) {
+	r, server := newAdapter(t, "")
+	ctx := context.Background()
+	assert.NoError(t, r.Register(ctx, service))
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "db1", Name: "db", IP: "10.0.0.3", Port: 5432}))
+	server.HSet("registrator:service:broken", "id", "broken", "name", "broken", "port", "x")
+
+	services, err := r.Services(ctx)
+
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []*bridge.Service{
+		service,
+		{ID: "db1", Name: "db", IP: "10.0.0.3", Port: 5432},
+	}, services)
+}
+
+func TestPublish(t *testing.T) {
+	r, _ := newAdapter(t, "channel=changes")
+	ctx := context.Background()
+	sub := r.client.Subscribe(ctx, "changes")
+	defer sub.Close()
+	_, err := sub.Receive(ctx)
+	assert.NoError(t, err)
+
+	assert.NoError(t, r.Register(ctx, service))
+	assert.NoError(t, r.Deregister(ctx, service))
+
+	for _, expected := range []string{"register", "deregister"} {
+		msg := <-sub.Channel()
+		var event Event
+		assert.NoError(t, json.Unmarshal([]byte(msg.Payload), &event))
+		assert.Equal(t, Event{Event: expected, ID: service.ID, Name: "redis", IP: "10.0.0.2", Port: 6379,
+			Tags: service.Tags, Attrs: service.Attrs}, event)
+	}
+}
+
+func TestWrongTypePermanent(t *testing.T) {
+	r, server := newAdapter(t, "")
+	server.Set("registrator:name:redis", "not a set")
+
+	err := r.Register(context.Background(), service)
+
+	assert.True(t, bridge.IsPermanent(err))
+}
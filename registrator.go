@@ -5,6 +5,9 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/42wim/registrator-work/bridge"
@@ -26,6 +29,10 @@ var deregister = flag.String("deregister", "always", "Deregister exited services
 var retryAttempts = flag.Int("retry-attempts", 0, "Max retry attempts to establish a connection with the backend. Use -1 for infinite retries")
 var retryInterval = flag.Int("retry-interval", 2000, "Interval (in millisecond) between retry-attempts.")
 var cleanup = flag.Bool("cleanup", false, "Remove dangling services")
+var backendTimeout = flag.Int("backend-timeout", 10, "Timeout (in seconds) of a single backend operation. Use 0 for no timeout")
+var concurrency = flag.Int("concurrency", bridge.DefaultConcurrency, "Number of containers synced or refreshed in parallel")
+var rateLimit = flag.Float64("rate-limit", 0, "Max backend operations per second. Use 0 for no limit")
+var shutdownDeregister = flag.Bool("shutdown-deregister", false, "Deregister all services when stopped by a signal")
 
 
 func getopt(name, def string) string {
@@ -64,6 +71,18 @@ func main() {
 		assert(errors.New("-retry-interval must be greater than 0"))
 	}
 
+	if *backendTimeout < 0 {
+		assert(errors.New("-backend-timeout must not be negative"))
+	}
+
+	if *concurrency <= 0 {
+		assert(errors.New("-concurrency must be greater than 0"))
+	}
+
+	if *rateLimit < 0 {
+		assert(errors.New("-rate-limit must not be negative"))
+	}
+
 	docker, err := dockerapi.NewClient(getopt("DOCKER_HOST", "unix:///tmp/docker.sock"))
 	assert(err)
 
@@ -79,10 +98,24 @@ func main() {
 		RefreshInterval: *refreshInterval,
 		DeregisterCheck: *deregister,
 		Cleanup:         *cleanup,
+		BackendTimeout:  *backendTimeout,
+		Concurrency:     *concurrency,
+		RateLimit:       *rateLimit,
+
+		DeregisterOnShutdown: *shutdownDeregister,
 	})
 
 	assert(err)
 
+	// Cancel backend operations in progress when asked to stop
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Println("Received", <-signals, "signal, shutting down ...")
+		b.Shutdown()
+		os.Exit(0)
+	}()
+
 	attempt := 0
 	for *retryAttempts == -1 || attempt <= *retryAttempts {
 		log.Printf("Connecting to backend (%v/%v)", attempt, *retryAttempts)
@@ -109,22 +142,6 @@ func main() {
 
 	quit := make(chan struct{})
 
-	// Start the TTL refresh timer
-	if *refreshInterval > 0 {
-		ticker := time.NewTicker(time.Duration(*refreshInterval) * time.Second)
-		go func() {
-			for {
-				select {
-				case <-ticker.C:
-					b.Refresh()
-				case <-quit:
-					ticker.Stop()
-					return
-				}
-			}
-		}()
-	}
-
 	// Start the resync timer if enabled
 	if *resyncInterval > 0 {
 		resyncTicker := time.NewTicker(time.Duration(*resyncInterval) * time.Second)
@@ -132,6 +149,9 @@ func main() {
 			for {
 				select {
 				case <-resyncTicker.C:
+					if err := b.Health(); err != nil {
+						log.Println("backend unhealthy:", err)
+					}
 					b.Sync(true)
 				case <-quit:
 					resyncTicker.Stop()
@@ -141,15 +161,19 @@ func main() {
 		}()
 	}
 
-	// Process Docker events
+	// Process Docker events, in order for each container
 	for msg := range events {
 		switch msg.Status {
 		case "start":
-			go b.Add(msg.ID)
+			b.Dispatch(msg.ID, b.Add)
 		case "die":
-			go b.RemoveOnExit(msg.ID)
+			b.Dispatch(msg.ID, b.RemoveOnExit)
 		case "stop", "kill":
-			go b.Remove(msg.ID)
+			b.Dispatch(msg.ID, b.Remove)
+		default:
+			if strings.HasPrefix(msg.Status, "health_status") {
+				b.Dispatch(msg.ID, b.UpdateHealth)
+			}
 		}
 	}
 
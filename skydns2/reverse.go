@@ -0,0 +1,139 @@
+package skydns2
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// SkyDNS reads a single PTR record per address, so services sharing an IP
+// take turns: the entry belongs to whichever service wrote it first and is
+// only refreshed or deleted by that one. Once it deregisters, the entry is
+// handed over to another service with the same IP, if any.
+
+// reversePath returns the key of the reverse entry of ip, below
+// in-addr.arpa or ip6.arpa, or "" if ip isn't an IP address.
+func reversePath(ip string) string {
+	addr := net.ParseIP(strings.Trim(ip, "[]"))
+	if addr == nil {
+		return ""
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return "/skydns/arpa/in-addr/" + strconv.Itoa(int(v4[0])) + "/" + strconv.Itoa(int(v4[1])) +
+			"/" + strconv.Itoa(int(v4[2])) + "/" + strconv.Itoa(int(v4[3]))
+	}
+	nibbles := make([]string, 0, 2*net.IPv6len)
+	for _, b := range addr {
+		nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&0xf), 16))
+	}
+	return "/skydns/arpa/ip6/" + strings.Join(nibbles, "/")
+}
+
+// pathName returns the DNS name SkyDNS serves the record at key under.
+func pathName(key string) string {
+	components := strings.Split(strings.TrimPrefix(key, "/skydns/"), "/")
+	for i, j := 0, len(components)-1; i < j; i, j = i+1, j-1 {
+		components[i], components[j] = components[j], components[i]
+	}
+	return strings.Join(components, ".")
+}
+
+// ptrName returns the name the reverse entry of a service points to,
+// <id>.<name>.<domain> whether or not it is published per tag, with the ID
+// turned into a DNS label.
+func (r *Skydns2Adapter) ptrName(name, id string) string {
+	return Label(id) + "." + name + "." + pathName(r.path)
+}
+
+func ptrRecord(name string) string {
+	value, _ := json.Marshal(struct {
+		Host string `json:"host"`
+	}{name})
+	return string(value)
+}
+
+// registerPTR points the reverse entry of the service's IP to it, unless
+// another service holds it, with the TTL of the forward records.
+func (r *Skydns2Adapter) registerPTR(service *bridge.Service) error {
+	key := reversePath(service.IP)
+	if key == "" {
+		return nil
+	}
+	value := ptrRecord(r.ptrName(service.Name, service.ID))
+	ttl := uint64(service.TTL)
+	_, err := r.client.CompareAndSwap(key, value, ttl, value, 0)
+	if isCode(err, keyNotFound) {
+		_, err = r.client.Create(key, value, ttl)
+	}
+	if isCode(err, testFailed) || isCode(err, nodeExist) {
+		return nil
+	}
+	return err
+}
+
+// deregisterPTR deletes the reverse entry of the service's IP if it holds
+// it, and hands it over to another service with the same IP.
+func (r *Skydns2Adapter) deregisterPTR(service *bridge.Service) error {
+	key := reversePath(service.IP)
+	if key == "" {
+		return nil
+	}
+	_, err := r.client.CompareAndDelete(key, ptrRecord(r.ptrName(service.Name, service.ID)), 0)
+	if isCode(err, keyNotFound) || isCode(err, testFailed) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	res, err := r.client.Get(r.path, false, true)
+	if isCode(err, keyNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	paths := r.servicePaths(service)
+	own := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		own[path] = true
+	}
+	var heirs []*etcd.Node
+	walkRecords(res.Node, func(node *etcd.Node) {
+		var rec Record
+		if !own[node.Key] && json.Unmarshal([]byte(node.Value), &rec) == nil && reversePath(rec.Host) == key {
+			heirs = append(heirs, node)
+		}
+	})
+	if len(heirs) == 0 {
+		return nil
+	}
+	sort.Slice(heirs, func(i, j int) bool { return heirs[i].Key < heirs[j].Key })
+	// records are at <name>/<id> or <name>/<tag>/<id>
+	components := strings.Split(strings.TrimPrefix(heirs[0].Key, r.path+"/"), "/")
+	name, id := components[0], components[len(components)-1]
+	_, err = r.client.Create(key, ptrRecord(r.ptrName(name, id)), uint64(heirs[0].TTL))
+	if isCode(err, nodeExist) {
+		return nil
+	}
+	return err
+}
+
+// walkRecords calls fn with every record below node.
+func walkRecords(node *etcd.Node, fn func(node *etcd.Node)) {
+	for _, child := range node.Nodes {
+		if child.Dir {
+			walkRecords(child, fn)
+		} else {
+			fn(child)
+		}
+	}
+}
+
+func isCode(err error, code int) bool {
+	e, ok := err.(*etcd.EtcdError)
+	return ok && e.ErrorCode == code
+}
@@ -1,82 +1,266 @@
 package skydns2
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/url"
+	"path"
 	"strconv"
 	"strings"
 
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/42wim/registrator-work/bridge"
+	etcdbackend "github.com/42wim/registrator-work/etcd"
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// etcd error codes
+const (
+	keyNotFound = 100
+	testFailed  = 101
+	nodeExist   = 105
 )
 
 func init() {
 	bridge.Register(new(Factory), "skydns2")
+	bridge.Register(new(Factory), "skydns2+https")
 }
 
 type Factory struct{}
 
-func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
-	urls := make([]string, 0)
-	if uri.Host != "" {
-		urls = append(urls, "http://"+uri.Host)
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
+	urls := etcdbackend.Endpoints(uri, "127.0.0.1:4001")
+	transport, err := etcdbackend.Transport(uri)
+	if err != nil {
+		return nil, fmt.Errorf("skydns2: %v", err)
 	}
 
 	if len(uri.Path) < 2 {
-		log.Fatal("skydns2: dns domain required e.g.: skydns2://<host>/<domain>")
+		return nil, errors.New("skydns2: dns domain required e.g.: skydns2://<host>/<domain>")
+	}
+
+	tagDomains := false
+	switch tags := uri.Query().Get("tags"); tags {
+	case "":
+	case "subdomains":
+		tagDomains = true
+	default:
+		return nil, fmt.Errorf("skydns2: unknown tags option %q, want \"subdomains\"", tags)
+	}
+
+	ptr := false
+	switch value := uri.Query().Get("ptr"); value {
+	case "", "false":
+	case "true":
+		ptr = true
+	default:
+		return nil, fmt.Errorf("skydns2: invalid ptr option %q, want \"true\" or \"false\"", value)
 	}
 
-	return &Skydns2Adapter{client: etcd.NewClient(urls), path: domainPath(uri.Path[1:])}
+	client := etcd.NewClient(urls)
+	client.SetTransport(transport)
+	if uri.User != nil {
+		password, _ := uri.User.Password()
+		client.SetCredentials(uri.User.Username(), password)
+	}
+	return &Skydns2Adapter{client: client, path: DomainPath("/skydns", uri.Path[1:]), tagDomains: tagDomains, ptr: ptr}, nil
 }
 
 type Skydns2Adapter struct {
 	client *etcd.Client
 	path   string
+
+	// tagDomains publishes services under a subdomain per tag,
+	// <tag>.<name>.<domain>, instead of <name>.<domain>.
+	tagDomains bool
+
+	// ptr also writes reverse entries pointing the IP of each service to
+	// its <id>.<name>.<domain> name.
+	ptr bool
 }
 
-func (r *Skydns2Adapter) Ping() error {
-	rr := etcd.NewRawRequest("GET", "version", nil, nil)
-	_, err := r.client.SendRequest(rr)
-	if err != nil {
+// Record is a service as SkyDNS and the CoreDNS etcd plugin read it.
+type Record struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Priority int    `json:"priority,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+	Text     string `json:"text,omitempty"`
+	TTL      int    `json:"ttl,omitempty"`
+	Group    string `json:"group,omitempty"`
+}
+
+// The go-etcd client takes no context, so every request runs through
+// bridge.Await.
+
+func (r *Skydns2Adapter) Ping(ctx context.Context) error {
+	return bridge.Await(ctx, func() error {
+		rr := etcd.NewRawRequest("GET", "version", nil, nil)
+		_, err := r.client.SendRequest(rr)
 		return err
-	}
-	return nil
+	})
 }
 
-func (r *Skydns2Adapter) Register(service *bridge.Service) error {
-	port := strconv.Itoa(service.Port)
-	record := `{"host":"` + service.IP + `","port":` + port + `}`
-	_, err := r.client.Set(r.servicePath(service), record, uint64(service.TTL))
+func (r *Skydns2Adapter) Register(ctx context.Context, service *bridge.Service) error {
+	value, err := ServiceRecord(service)
 	if err != nil {
 		log.Println("skydns2: failed to register service:", err)
+		return bridge.Permanent(err)
 	}
-	return err
+	err = bridge.Await(ctx, func() error {
+		for _, path := range r.servicePaths(service) {
+			if _, err := r.client.Set(path, value, uint64(service.TTL)); err != nil {
+				return err
+			}
+		}
+		if r.ptr {
+			return r.registerPTR(service)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("skydns2: failed to register service:", err)
+	}
+	return etcdbackend.Classify(err)
 }
 
-func (r *Skydns2Adapter) Deregister(service *bridge.Service) error {
-	_, err := r.client.Delete(r.servicePath(service), false)
+func (r *Skydns2Adapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	err := bridge.Await(ctx, func() error {
+		for _, path := range r.servicePaths(service) {
+			if _, err := r.client.Delete(path, false); err != nil {
+				return err
+			}
+		}
+		if r.ptr {
+			return r.deregisterPTR(service)
+		}
+		return nil
+	})
 	if err != nil {
 		log.Println("skydns2: failed to register service:", err)
 	}
-	return err
+	return etcdbackend.Classify(err)
 }
 
-func (r *Skydns2Adapter) Refresh(service *bridge.Service) error {
-	return r.Register(service)
+func (r *Skydns2Adapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	return r.Register(ctx, service)
 }
 
-func (r *Skydns2Adapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+func (r *Skydns2Adapter) Services(ctx context.Context) ([]*bridge.Service, error) {
+	var res *etcd.Response
+	err := bridge.Await(ctx, func() error {
+		var err error
+		res, err = r.client.Get(r.path, false, true)
+		return err
+	})
+	if isCode(err, keyNotFound) {
+		return []*bridge.Service{}, nil
+	} else if err != nil {
+		return []*bridge.Service{}, err
+	}
+	return parseServices(res.Node), nil
+}
+
+// parseServices reads the services below the domain node, at
+// <name>/<id> or, per tag, at <name>/<tag>/<id>.
+func parseServices(domain *etcd.Node) []*bridge.Service {
+	services := make([]*bridge.Service, 0)
+	byID := make(map[string]*bridge.Service)
+	add := func(name string, tag string, node *etcd.Node) {
+		var rec Record
+		if err := json.Unmarshal([]byte(node.Value), &rec); err != nil {
+			log.Println("skydns2: skipping", node.Key+":", err)
+			return
+		}
+		id := path.Base(node.Key)
+		service := byID[id]
+		if service == nil {
+			service = &bridge.Service{ID: id, Name: name, IP: rec.Host, Port: rec.Port}
+			byID[id] = service
+			services = append(services, service)
+		}
+		if tag != "" {
+			service.Tags = append(service.Tags, tag)
+		}
+	}
+	for _, name := range domain.Nodes {
+		for _, node := range name.Nodes {
+			if !node.Dir {
+				add(path.Base(name.Key), "", node)
+				continue
+			}
+			for _, id := range node.Nodes {
+				if !id.Dir {
+					add(path.Base(name.Key), path.Base(node.Key), id)
+				}
+			}
+		}
+	}
+	return services
+}
+
+// servicePaths returns the keys of service, one per tag if services are
+// published under tag subdomains and it has tags. The keys end in the ID as
+// is, which parseServices reads back.
+func (r *Skydns2Adapter) servicePaths(service *bridge.Service) []string {
+	if !r.tagDomains || len(service.Tags) == 0 {
+		return []string{r.path + "/" + service.Name + "/" + service.ID}
+	}
+	paths := make([]string, 0, len(service.Tags))
+	for _, tag := range service.Tags {
+		paths = append(paths, r.path+"/"+service.Name+"/"+Label(tag)+"/"+service.ID)
+	}
+	return paths
+}
+
+// ServiceRecord encodes service for SkyDNS, taking the SRV priority and
+// weight, the TXT data, the DNS TTL and the group from the skydns_priority,
+// skydns_weight, skydns_text, skydns_ttl and skydns_group attributes.
+func ServiceRecord(service *bridge.Service) (string, error) {
+	rec := Record{
+		Host:  service.IP,
+		Port:  service.Port,
+		Text:  service.Attrs["skydns_text"],
+		Group: service.Attrs["skydns_group"],
+	}
+	// SkyDNS answers A or AAAA queries depending on the host being an IPv4
+	// or IPv6 address, which it only recognizes without brackets or zone
+	if ip := net.ParseIP(strings.Trim(service.IP, "[]")); ip != nil {
+		rec.Host = ip.String()
+	}
+	for attr, field := range map[string]*int{
+		"skydns_priority": &rec.Priority,
+		"skydns_weight":   &rec.Weight,
+		"skydns_ttl":      &rec.TTL,
+	} {
+		value := service.Attrs[attr]
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("invalid %s %q", attr, value)
+		}
+		*field = n
+	}
+	value, err := json.Marshal(rec)
+	return string(value), err
 }
 
-func (r *Skydns2Adapter) servicePath(service *bridge.Service) string {
-	return r.path + "/" + service.Name + "/" + service.ID
+// Label turns a tag into a DNS label, replacing colons with dashes.
+func Label(s string) string {
+	return strings.Replace(s, ":", "-", -1)
 }
 
-func domainPath(domain string) string {
+// DomainPath returns the key below root of the records of domain, made of
+// its labels in reverse order, e.g. /skydns/local/cluster for cluster.local.
+func DomainPath(root, domain string) string {
 	components := strings.Split(domain, ".")
 	for i, j := 0, len(components)-1; i < j; i, j = i+1, j-1 {
 		components[i], components[j] = components[j], components[i]
 	}
-	return "/skydns/" + strings.Join(components, "/")
+	return root + "/" + strings.Join(components, "/")
 }
@@ -0,0 +1,89 @@
+package skydns2
+
+import (
+	"testing"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainPath(t *testing.T) {
+	assert.Equal(t, "/skydns/local/cluster", DomainPath("/skydns", "cluster.local"))
+}
+
+func TestServiceRecord(t *testing.T) {
+	for _, test := range []struct {
+		service  *bridge.Service
+		expected string
+	}{
+		{&bridge.Service{IP: "10.0.0.2", Port: 80}, `{"host":"10.0.0.2","port":80}`},
+		{&bridge.Service{IP: "[2001:db8:0::1]", Port: 80}, `{"host":"2001:db8::1","port":80}`},
+		{&bridge.Service{IP: "10.0.0.2", Port: 80, Attrs: map[string]string{
+			"skydns_priority": "10",
+			"skydns_weight":   "20",
+			"skydns_text":     "v=1",
+			"skydns_ttl":      "60",
+			"skydns_group":    "east",
+		}}, `{"host":"10.0.0.2","port":80,"priority":10,"weight":20,"text":"v=1","ttl":60,"group":"east"}`},
+	} {
+		value, err := ServiceRecord(test.service)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, value)
+	}
+
+	_, err := ServiceRecord(&bridge.Service{Attrs: map[string]string{"skydns_weight": "heavy"}})
+	assert.EqualError(t, err, `invalid skydns_weight "heavy"`)
+}
+
+func TestServicePaths(t *testing.T) {
+	service := &bridge.Service{ID: "host:web:80:ipv6", Name: "web", Tags: []string{"a", "b:c"}}
+
+	r := &Skydns2Adapter{path: "/skydns/local/cluster"}
+	assert.Equal(t, []string{"/skydns/local/cluster/web/host:web:80:ipv6"}, r.servicePaths(service))
+
+	r.tagDomains = true
+	assert.Equal(t, []string{
+		"/skydns/local/cluster/web/a/host:web:80:ipv6",
+		"/skydns/local/cluster/web/b-c/host:web:80:ipv6",
+	}, r.servicePaths(service))
+}
+
+func TestParseServices(t *testing.T) {
+	domain := &etcd.Node{Key: "/skydns/local/cluster", Dir: true, Nodes: etcd.Nodes{
+		{Key: "/skydns/local/cluster/db", Dir: true, Nodes: etcd.Nodes{
+			{Key: "/skydns/local/cluster/db/host:db:5432", Value: `{"host":"10.0.0.3","port":5432}`},
+			{Key: "/skydns/local/cluster/db/db-2", Value: `garbage`},
+		}},
+		{Key: "/skydns/local/cluster/web", Dir: true, Nodes: etcd.Nodes{
+			{Key: "/skydns/local/cluster/web/a", Dir: true, Nodes: etcd.Nodes{
+				{Key: "/skydns/local/cluster/web/a/web-1", Value: `{"host":"10.0.0.2","port":80}`},
+			}},
+			{Key: "/skydns/local/cluster/web/b", Dir: true, Nodes: etcd.Nodes{
+				{Key: "/skydns/local/cluster/web/b/web-1", Value: `{"host":"10.0.0.2","port":80}`},
+			}},
+		}},
+	}}
+
+	assert.Equal(t, []*bridge.Service{
+		{ID: "host:db:5432", Name: "db", IP: "10.0.0.3", Port: 5432},
+		{ID: "web-1", Name: "web", IP: "10.0.0.2", Port: 80, Tags: []string{"a", "b"}},
+	}, parseServices(domain))
+}
+
+func TestReversePath(t *testing.T) {
+	assert.Equal(t, "/skydns/arpa/in-addr/10/0/0/2", reversePath("10.0.0.2"))
+	assert.Equal(t, "/skydns/arpa/ip6/2/0/0/1/0/d/b/8/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/1", reversePath("[2001:db8::1]"))
+	assert.Equal(t, "", reversePath("example.com"))
+}
+
+func TestPathName(t *testing.T) {
+	assert.Equal(t, "web-1.web.cluster.local", pathName("/skydns/local/cluster/web/web-1"))
+	assert.Equal(t, `{"host":"web-1.web.cluster.local"}`, ptrRecord(pathName("/skydns/local/cluster/web/web-1")))
+}
+
+func TestPTRName(t *testing.T) {
+	r := &Skydns2Adapter{path: "/skydns/local/cluster", tagDomains: true}
+
+	assert.Equal(t, "host-web-80.web.cluster.local", r.ptrName("web", "host:web:80"))
+}
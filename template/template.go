@@ -0,0 +1,352 @@
+package template
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/42wim/registrator-work/internal/atomicfile"
+)
+
+const (
+	// DefaultDelay is how long a render waits for more changes unless
+	// configured otherwise, so that containers started together cause a
+	// single reload.
+	DefaultDelay = time.Second
+
+	// DefaultTimeout bounds the reload command unless configured otherwise.
+	DefaultTimeout = 30 * time.Second
+)
+
+func init() {
+	bridge.Register(new(Factory), "template")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
+	if uri.Path == "" {
+		return nil, errors.New("template: templates required e.g.: template:///etc/haproxy/haproxy.cfg.tmpl:/etc/haproxy/haproxy.cfg")
+	}
+	query := uri.Query()
+
+	var templates []*output
+	for _, pair := range strings.Split(uri.Path, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("template: %q is not <template>:<output>", pair)
+		}
+		tmpl, err := template.New(filepath.Base(parts[0])).Funcs(funcs).ParseFiles(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("template: %v", err)
+		}
+		templates = append(templates, &output{tmpl: tmpl, path: parts[1]})
+	}
+
+	delay, err := duration(query, "delay", DefaultDelay)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := duration(query, "timeout", DefaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TemplateAdapter{
+		templates: templates,
+		command:   query.Get("command"),
+		delay:     delay,
+		timeout:   timeout,
+		services:  make(map[string]*bridge.Service),
+	}, nil
+}
+
+func duration(query url.Values, name string, value time.Duration) (time.Duration, error) {
+	if s := query.Get(name); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("template: invalid %s %q", name, s)
+		}
+		return d, nil
+	}
+	return value, nil
+}
+
+// TemplateAdapter renders Go templates from the registered services and
+// runs a command to reload whatever reads the output once it changed.
+type TemplateAdapter struct {
+	sync.Mutex
+	templates []*output
+	command   string // run with sh -c, if set
+	delay     time.Duration
+	timeout   time.Duration
+
+	services map[string]*bridge.Service // by service ID
+	timer    *time.Timer                // pending render, if any
+	started  bool
+
+	rendering sync.Mutex // held while rendering and reloading
+	failed    bool       // the last reload failed, guarded by rendering
+}
+
+// output is a template and the file it is rendered to.
+type output struct {
+	tmpl *template.Template
+	path string
+}
+
+// Ping checks that the directories of the outputs exist. The first
+// successful call schedules a render, so that the outputs reflect the
+// services even if none is registered.
+func (r *TemplateAdapter) Ping(ctx context.Context) error {
+	for _, out := range r.templates {
+		dir := filepath.Dir(out.path)
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("template: %v", err)
+		}
+		if !info.IsDir() {
+			return bridge.Permanent(fmt.Errorf("template: %s is not a directory", dir))
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if !r.started {
+		r.started = true
+		r.schedule()
+	}
+	return nil
+}
+
+func (r *TemplateAdapter) Register(ctx context.Context, service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	r.services[service.ID] = service
+	r.schedule()
+	return nil
+}
+
+func (r *TemplateAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.services[service.ID]; ok {
+		delete(r.services, service.ID)
+		r.schedule()
+	}
+	return nil
+}
+
+func (r *TemplateAdapter) Services(ctx context.Context) ([]*bridge.Service, error) {
+	r.Lock()
+	defer r.Unlock()
+	services := make([]*bridge.Service, 0, len(r.services))
+	for _, service := range r.services {
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// schedule renders the templates in the background after the delay,
+// together with the changes made in the meantime, so that registrations
+// never wait for a render or reload. Failures are logged rather than
+// failing the registration, since the service is known either way and the
+// next change renders again. Must be called with the lock held.
+func (r *TemplateAdapter) schedule() {
+	if r.timer != nil {
+		return
+	}
+	r.timer = time.AfterFunc(r.delay, r.render)
+}
+
+// render writes the outputs whose content changed, and runs the reload
+// command if any did or the last reload failed.
+func (r *TemplateAdapter) render() {
+	r.rendering.Lock()
+	defer r.rendering.Unlock()
+
+	r.Lock()
+	r.timer = nil
+	data := newData(r.services)
+	r.Unlock()
+
+	if err := r.write(data); err != nil {
+		log.Println("template: render failed:", err)
+	}
+}
+
+// write renders data to the outputs. Must be called with rendering held.
+func (r *TemplateAdapter) write(data *Data) error {
+	reload := r.failed
+	for _, out := range r.templates {
+		var buf bytes.Buffer
+		if err := out.tmpl.Execute(&buf, data); err != nil {
+			return err
+		}
+		current, err := ioutil.ReadFile(out.path)
+		if err == nil && bytes.Equal(current, buf.Bytes()) {
+			continue
+		}
+		if err := atomicfile.WriteFile(out.path, buf.Bytes()); err != nil {
+			return err
+		}
+		log.Println("template: rendered", out.path)
+		reload = true
+	}
+	if reload && r.command != "" {
+		r.failed = !r.reload()
+	}
+	return nil
+}
+
+// reload runs the reload command and logs its output. It reports whether
+// the command succeeded.
+func (r *TemplateAdapter) reload() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", r.command)
+	// don't wait for children left holding the output once sh is killed
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if line != "" {
+			log.Println("template: reload:", line)
+		}
+	}
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		log.Printf("template: reload command timed out after %v", r.timeout)
+	case err != nil:
+		log.Println("template: reload command failed:", err)
+	default:
+		return true
+	}
+	return false
+}
+
+// Data is what the templates are executed with.
+type Data struct {
+	Services []*Group // sorted by name
+}
+
+// Service returns the group of the service with the name, or nil.
+func (d *Data) Service(name string) *Group {
+	for _, group := range d.Services {
+		if group.Name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// Group holds the instances of a service.
+type Group struct {
+	Name      string
+	Tags      []string    // tags of any instance, sorted
+	Instances []*Instance // sorted by ID
+}
+
+// Healthy returns the instances that are healthy.
+func (g *Group) Healthy() []*Instance {
+	var instances []*Instance
+	for _, instance := range g.Instances {
+		if instance.Healthy() {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
+
+// Tagged returns the instances with the tag.
+func (g *Group) Tagged(tag string) []*Instance {
+	var instances []*Instance
+	for _, instance := range g.Instances {
+		if instance.HasTag(tag) {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
+
+// Instance is a registered service, with its fields such as .ID, .IP,
+// .Port, .Tags and .Attrs.
+type Instance struct {
+	*bridge.Service
+}
+
+// Address returns the address of the instance as <ip>:<port>.
+func (i *Instance) Address() string {
+	return net.JoinHostPort(strings.Trim(i.IP, "[]"), strconv.Itoa(i.Port))
+}
+
+// Health returns the status of the container's Docker health check,
+// "starting", "healthy" or "unhealthy", or "" without one.
+func (i *Instance) Health() string {
+	return i.Origin.Health
+}
+
+// Healthy reports whether the instance has no health check or passes it.
+func (i *Instance) Healthy() bool {
+	return i.Origin.Health == "" || i.Origin.Health == "healthy"
+}
+
+func (i *Instance) HasTag(tag string) bool {
+	for _, t := range i.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+var funcs = template.FuncMap{
+	"join": func(sep string, s []string) string { return strings.Join(s, sep) },
+}
+
+func newData(services map[string]*bridge.Service) *Data {
+	groups := make(map[string]*Group)
+	tags := make(map[string]map[string]bool)
+	for _, service := range services {
+		group := groups[service.Name]
+		if group == nil {
+			group = &Group{Name: service.Name}
+			groups[service.Name] = group
+			tags[service.Name] = make(map[string]bool)
+		}
+		group.Instances = append(group.Instances, &Instance{service})
+		for _, tag := range service.Tags {
+			tags[service.Name][tag] = true
+		}
+	}
+
+	data := &Data{Services: make([]*Group, 0, len(groups))}
+	for name, group := range groups {
+		for tag := range tags[name] {
+			group.Tags = append(group.Tags, tag)
+		}
+		sort.Strings(group.Tags)
+		sort.Slice(group.Instances, func(i, j int) bool {
+			return group.Instances[i].ID < group.Instances[j].ID
+		})
+		data.Services = append(data.Services, group)
+	}
+	sort.Slice(data.Services, func(i, j int) bool {
+		return data.Services[i].Name < data.Services[j].Name
+	})
+	return data
+}
@@ -0,0 +1,172 @@
+package template
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/stretchr/testify/assert"
+)
+
+const upstreams = `{{range .Services}}{{.Name}} [{{join "," .Tags}}]:{{range .Healthy}} {{.Address}}{{end}}
+{{end}}{{with .Service "web"}}primary:{{range .Tagged "primary"}} {{.ID}}={{.Health}}{{end}}
+{{end}}`
+
+// newAdapter returns an adapter rendering the template text to a file in
+// a temporary directory, and the path of that file.
+func newAdapter(t *testing.T, text, query string) (*TemplateAdapter, string) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "upstreams.tmpl")
+	dest := filepath.Join(dir, "upstreams.conf")
+	if err := ioutil.WriteFile(src, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	adapter, err := new(Factory).New(&url.URL{Scheme: "template", Path: src + ":" + dest, RawQuery: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return adapter.(*TemplateAdapter), dest
+}
+
+// settle waits until the pending render, if any, is done.
+func settle(t *testing.T, r *TemplateAdapter) {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		r.Lock()
+		pending := r.timer != nil
+		r.Unlock()
+		if !pending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("render still pending")
+		}
+	}
+	r.rendering.Lock()
+	r.rendering.Unlock()
+}
+
+func read(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFactoryErrors(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/in.tmpl":                    `template: "/in.tmpl" is not <template>:<output>`,
+		"/in.tmpl:":                   `template: "/in.tmpl:" is not <template>:<output>`,
+		"/nonexistent.tmpl:/out.conf": "template: open /nonexistent.tmpl: no such file or directory",
+	} {
+		_, err := new(Factory).New(&url.URL{Scheme: "template", Path: path})
+		assert.EqualError(t, err, expected)
+	}
+
+	_, err := new(Factory).New(&url.URL{Scheme: "template"})
+	assert.Error(t, err)
+}
+
+func TestRender(t *testing.T) {
+	r, dest := newAdapter(t, upstreams, "delay=0")
+	ctx := context.Background()
+
+	assert.NoError(t, r.Ping(ctx))
+	settle(t, r)
+	assert.Equal(t, "", read(t, dest))
+
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "web2", Name: "web", IP: "10.0.0.3", Port: 80, Tags: []string{"primary"},
+		Origin: bridge.ServicePort{Health: "healthy"}}))
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80, Tags: []string{"canary", "primary"},
+		Origin: bridge.ServicePort{Health: "starting"}}))
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "db1", Name: "db", IP: "2001:db8::1", Port: 5432}))
+	settle(t, r)
+
+	assert.Equal(t, `db []: [2001:db8::1]:5432
+web [canary,primary]: 10.0.0.3:80
+primary: web1=starting web2=healthy
+`, read(t, dest))
+
+	assert.NoError(t, r.Deregister(ctx, &bridge.Service{ID: "db1"}))
+	settle(t, r)
+	assert.NotContains(t, read(t, dest), "db")
+}
+
+func TestReloadOnChange(t *testing.T) {
+	count := filepath.Join(t.TempDir(), "count")
+	r, _ := newAdapter(t, upstreams, "delay=0&command=echo+reloaded+%3E%3E"+url.QueryEscape(count))
+	ctx := context.Background()
+	service := &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80}
+
+	assert.NoError(t, r.Ping(ctx))
+	settle(t, r)
+	assert.NoError(t, r.Register(ctx, service))
+	settle(t, r)
+	assert.NoError(t, r.Register(ctx, service))
+	settle(t, r)
+	assert.NoError(t, r.Deregister(ctx, &bridge.Service{ID: "unknown"}))
+	settle(t, r)
+
+	assert.Equal(t, "reloaded\nreloaded\n", read(t, count))
+}
+
+func TestReloadRetriedAfterFailure(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "fail")
+	r, _ := newAdapter(t, upstreams, "delay=0&command=test+%21+-e+"+url.QueryEscape(marker))
+	ctx := context.Background()
+	assert.NoError(t, ioutil.WriteFile(marker, nil, 0644))
+
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80}))
+	settle(t, r)
+	assert.True(t, r.failed)
+
+	os.Remove(marker)
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80}))
+	settle(t, r)
+	assert.False(t, r.failed)
+}
+
+func TestReloadTimeout(t *testing.T) {
+	r, _ := newAdapter(t, upstreams, "delay=0&timeout=50ms&command=sleep+10")
+
+	start := time.Now()
+	assert.NoError(t, r.Register(context.Background(), &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80}))
+	settle(t, r)
+
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.True(t, r.failed)
+}
+
+func TestDelayedRender(t *testing.T) {
+	r, dest := newAdapter(t, upstreams, "delay=50ms")
+	ctx := context.Background()
+
+	for _, id := range []string{"web1", "web2", "web3"} {
+		assert.NoError(t, r.Register(ctx, &bridge.Service{ID: id, Name: "web", IP: "10.0.0.2", Port: 80}))
+	}
+	_, err := os.Stat(dest)
+	assert.True(t, os.IsNotExist(err))
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 3, strings.Count(read(t, dest), "10.0.0.2:80"))
+	files, _ := ioutil.ReadDir(filepath.Dir(dest))
+	assert.Len(t, files, 2, "temporary files left behind")
+}
+
+func TestRegisterDoesNotWaitForReload(t *testing.T) {
+	r, _ := newAdapter(t, upstreams, "delay=0&command=sleep+1")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "web1", Name: "web", IP: "10.0.0.2", Port: 80}))
+	assert.NoError(t, r.Register(ctx, &bridge.Service{ID: "web2", Name: "web", IP: "10.0.0.3", Port: 80}))
+
+	assert.NoError(t, ctx.Err())
+	settle(t, r)
+}
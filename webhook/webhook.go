@@ -0,0 +1,276 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/42wim/registrator-work/bridge"
+	"github.com/cenkalti/backoff"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the body, as
+	// sha256=<hex>, if a secret is configured.
+	SignatureHeader = "X-Registrator-Signature"
+
+	// EventHeader carries the event of the document.
+	EventHeader = "X-Registrator-Event"
+
+	// DefaultRetries is how many times a failed POST is retried unless
+	// configured otherwise.
+	DefaultRetries = 3
+)
+
+func init() {
+	f := new(Factory)
+	bridge.Register(f, "webhook")
+	bridge.Register(f, "webhooks")
+}
+
+type Factory struct{}
+
+// SecretOptions keeps the signing key and the headers, which may carry
+// credentials, out of the logged URI.
+func (f *Factory) SecretOptions() []string {
+	return []string{"secret", "header"}
+}
+
+func (f *Factory) New(uri *url.URL) (bridge.RegistryAdapter, error) {
+	if uri.Host == "" {
+		return nil, fmt.Errorf("webhook: host required e.g.: %s://example.com/hooks/registrator", uri.Scheme)
+	}
+	target := *uri
+	target.Scheme = "http"
+	if uri.Scheme == "webhooks" {
+		target.Scheme = "https"
+	}
+
+	// the options of the adapter are taken out, the rest of the query is
+	// passed on to the receiver
+	query := uri.Query()
+	option := func(name string) string {
+		value := query.Get(name)
+		query.Del(name)
+		return value
+	}
+
+	r := &WebhookAdapter{
+		client:  http.DefaultClient,
+		header:  make(http.Header),
+		secret:  []byte(option("secret")),
+		retries: DefaultRetries,
+		backoff: func() backoff.BackOff { return backoff.NewExponentialBackOff() },
+	}
+	for _, header := range query["header"] {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("webhook: header %q is not <name>:<value>", header)
+		}
+		r.header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	query.Del("header")
+	if value := option("refresh"); value != "" {
+		refresh, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("webhook: invalid refresh %q", value)
+		}
+		r.refresh = refresh
+	}
+	if value := option("retries"); value != "" {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("webhook: invalid retries %q", value)
+		}
+		r.retries = retries
+	}
+	health := option("health")
+
+	target.RawQuery = query.Encode()
+	r.url = target.String()
+	if health != "" {
+		healthURL, err := target.Parse(health)
+		if err != nil {
+			return nil, fmt.Errorf("webhook: invalid health %q", health)
+		}
+		r.health = healthURL.String()
+	}
+	return r, nil
+}
+
+// WebhookAdapter posts an Event to a URL for every registration and
+// deregistration, and optionally for every refresh.
+type WebhookAdapter struct {
+	client  *http.Client
+	url     string
+	health  string // URL Ping gets, if set
+	header  http.Header
+	secret  []byte // HMAC key of the signature, if set
+	refresh bool
+	retries int
+	backoff func() backoff.BackOff
+}
+
+// Event is the document posted for an operation.
+type Event struct {
+	Event   string    `json:"event"` // register, deregister or refresh
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Service Service   `json:"service"`
+	Origin  Origin    `json:"origin"`
+}
+
+// Service describes the service of an event.
+type Service struct {
+	ID    string            `json:"id"`
+	Name  string            `json:"name"`
+	IP    string            `json:"ip"`
+	Port  int               `json:"port"`
+	Tags  []string          `json:"tags,omitempty"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+	TTL   int               `json:"ttl,omitempty"`
+}
+
+// Origin describes the container and port the service was found on.
+type Origin struct {
+	ContainerID       string `json:"container_id"`
+	ContainerName     string `json:"container_name"`
+	ContainerHostname string `json:"container_hostname,omitempty"`
+	HostIP            string `json:"host_ip,omitempty"`
+	HostPort          string `json:"host_port,omitempty"`
+	ExposedIP         string `json:"exposed_ip,omitempty"`
+	ExposedPort       string `json:"exposed_port,omitempty"`
+	Protocol          string `json:"protocol,omitempty"`
+	Health            string `json:"health,omitempty"`
+}
+
+// Ping gets the health URL, if configured, and expects a 2xx response.
+func (r *WebhookAdapter) Ping(ctx context.Context) error {
+	if r.health == "" {
+		return nil
+	}
+	req, err := http.NewRequest("GET", r.health, nil)
+	if err != nil {
+		return bridge.Permanent(err)
+	}
+	return r.do(ctx, req)
+}
+
+func (r *WebhookAdapter) Register(ctx context.Context, service *bridge.Service) error {
+	return r.post(ctx, "register", service)
+}
+
+func (r *WebhookAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	return r.post(ctx, "deregister", service)
+}
+
+func (r *WebhookAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	if !r.refresh {
+		return nil
+	}
+	return r.post(ctx, "refresh", service)
+}
+
+// post sends the event about service, retrying with backoff until the
+// receiver takes it, rejects it or the retries run out. Since it retries
+// itself, its errors are permanent.
+func (r *WebhookAdapter) post(ctx context.Context, event string, service *bridge.Service) error {
+	body, err := json.Marshal(newEvent(event, service))
+	if err != nil {
+		return bridge.Permanent(err)
+	}
+	var signature string
+	if len(r.secret) > 0 {
+		mac := hmac.New(sha256.New, r.secret)
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	policy := backoff.WithContext(backoff.WithMaxRetries(r.backoff(), uint64(r.retries)), ctx)
+	err = backoff.Retry(func() error {
+		req, err := http.NewRequest("POST", r.url, bytes.NewReader(body))
+		if err != nil {
+			return bridge.Permanent(err)
+		}
+		for name, values := range r.header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(EventHeader, event)
+		if signature != "" {
+			req.Header.Set(SignatureHeader, signature)
+		}
+		err = r.do(ctx, req)
+		if bridge.IsPermanent(err) {
+			return &backoff.PermanentError{Err: err}
+		}
+		return err
+	}, policy)
+	if permanent, ok := err.(*backoff.PermanentError); ok {
+		err = permanent.Err
+	}
+	if err != nil {
+		log.Printf("webhook: failed to post %s of %s: %v", event, service.ID, err)
+		return bridge.Permanent(err)
+	}
+	return nil
+}
+
+// do sends req and expects a 2xx response.
+func (r *WebhookAdapter) do(ctx context.Context, req *http.Request) error {
+	res, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), res.Status)
+	if bridge.PermanentStatus(res.StatusCode) {
+		return bridge.Permanent(err)
+	}
+	return err
+}
+
+func newEvent(event string, service *bridge.Service) *Event {
+	return &Event{
+		Event: event,
+		Time:  time.Now().UTC(),
+		Host:  bridge.Hostname,
+		Service: Service{
+			ID:    service.ID,
+			Name:  service.Name,
+			IP:    service.IP,
+			Port:  service.Port,
+			Tags:  service.Tags,
+			Attrs: service.Attrs,
+			TTL:   service.TTL,
+		},
+		Origin: Origin{
+			ContainerID:       service.Origin.ContainerID,
+			ContainerName:     service.Origin.ContainerName,
+			ContainerHostname: service.Origin.ContainerHostname,
+			HostIP:            service.Origin.HostIP,
+			HostPort:          service.Origin.HostPort,
+			ExposedIP:         service.Origin.ExposedIP,
+			ExposedPort:       service.Origin.ExposedPort,
+			Protocol:          service.Origin.PortType,
+			Health:            service.Origin.Health,
+		},
+	}
+}